@@ -31,6 +31,25 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(MiddlewareSpec)
 	r.AddSpec(MiddlewareRetrySpec)
 	r.AddSpec(MiddlewareStatsSpec)
+	r.AddSpec(PauseSpec)
+	r.AddSpec(MultiFetchSpec)
+	r.AddSpec(ContextSpec)
+	r.AddSpec(TimeoutSpec)
+	r.AddSpec(DeadSpec)
+	r.AddSpec(RetryPolicySpec)
+	r.AddSpec(RetryErrorsSpec)
+	r.AddSpec(HeartbeatSpec)
+	r.AddSpec(ReaperSpec)
+	r.AddSpec(LeaseFetchSpec)
+	r.AddSpec(PrefetchSpec)
+	r.AddSpec(PeriodicSpec)
+	r.AddSpec(UniqueSpec)
+	r.AddSpec(RateLimitSpec)
+	r.AddSpec(ConcurrencyLimitSpec)
+	r.AddSpec(BatchSpec)
+	r.AddSpec(WorkflowSpec)
+	r.AddSpec(JobStatusSpec)
+	r.AddSpec(CancelSpec)
 
 	// Run GoSpec and report any errors to gotest's `testing.T` instance
 	gospec.MainGoTest(r, t)
@@ -12,15 +12,43 @@ type GoWorkers interface {
 	ResetManagers() error
 
 	Process(queue string, job jobFunc, concurrency int, mids ...Action)
+	ProcessWithContext(queue string, job ContextJobFunc, concurrency int, mids ...Action)
+	ProcessWithOptions(queue string, job ContextJobFunc, concurrency int, opts ProcessOptions, mids ...Action) error
+	ProcessQueues(queues []WeightedQueue, order QueueOrder, job jobFunc, concurrency int, mids ...Action)
+	ProcessQueuesWithContext(queues []WeightedQueue, order QueueOrder, job ContextJobFunc, concurrency int, mids ...Action)
+	SetConcurrency(queue string, concurrency int) error
 
 	Enqueue(queue, class string, args interface{}) (string, error)
 	EnqueueIn(queue, class string, in float64, args interface{}) (string, error)
 	EnqueueAt(queue, class string, at time.Time, args interface{}) (string, error)
 	EnqueueWithOptions(queue, class string, args interface{}, opts EnqueueOptions) (string, error)
 
+	Periodic(spec, queue, class string, args interface{}, opts PeriodicOptions) error
+	PeriodicJobs() ([]*PeriodicJob, error)
+
 	BeforeStart(f func())
 	DuringDrain(f func())
 
+	PauseQueue(queue string) error
+	ResumeQueue(queue string) error
+	QueuePaused(queue string) (bool, error)
+
+	SetRetryPolicy(class string, policy RetryPolicy)
+	SetRateLimiter(class string, limiter RateLimiter) error
+	SetConcurrencyLimit(class string, limit ConcurrencyLimit) error
+
+	NewBatch(description string) (*Batch, error)
+	BatchStatus(bid string) (*BatchStatus, error)
+	NewWorkflow(description string) *Workflow
+	WorkflowStatus(id string) (*WorkflowStatus, error)
+
+	JobStatus(jid string) (*JobStatus, error)
+	Cancel(jid string) error
+
+	DeadJobs(start, stop int) ([]*DeadJob, error)
+	RetryDeadJob(jid string) error
+	DeleteDeadJob(jid string) error
+
 	Ping() error
 	QueueStats() (queueStats *QueueStats, err error)
 
@@ -0,0 +1,350 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// How long a batch is kept after it last changed, in seconds.
+const batchTTL = 30 * 24 * 60 * 60
+
+var ErrBatchNotFound = errors.New("batch not found")
+
+// Batch groups jobs so that callbacks are enqueued when they've all
+// succeeded, or all finished. Jobs are added by enqueuing them with the
+// batch's ID in EnqueueOptions.BatchID, including from jobs of the batch.
+type Batch struct {
+	ID string
+
+	workers    *Workers
+	onSuccess  *EnqueueData
+	onComplete *EnqueueData
+}
+
+// BatchStatus counts the jobs of a batch. Pending jobs haven't succeeded
+// yet, failed ones are pending jobs that failed at least once.
+type BatchStatus struct {
+	ID          string
+	Description string
+	Total       int
+	Pending     int
+	Failures    int
+	FailedJids  []string
+	CreatedAt   time.Time
+	// CompletedAt is when every job had succeeded or failed, zero until then.
+	CompletedAt time.Time
+	// SucceededAt is when every job had succeeded, zero until then.
+	SucceededAt time.Time
+}
+
+// Counts a job in a batch, once. Returns false if there's no such batch.
+//
+// KEYS[1]: the batch
+// KEYS[2]: the JIDs of pending jobs
+// ARGV[1]: the JID of the job
+// ARGV[2]: how long to keep the batch, in seconds
+var batchAddScript = redis.NewScript(2, `
+if redis.call('exists', KEYS[1]) == 0 then
+	return 0
+end
+if redis.call('sadd', KEYS[2], ARGV[1]) == 1 then
+	redis.call('hincrby', KEYS[1], 'total', 1)
+	redis.call('hincrby', KEYS[1], 'pending', 1)
+end
+redis.call('expire', KEYS[1], ARGV[2])
+redis.call('expire', KEYS[2], ARGV[2])
+return 1
+`)
+
+// Uncounts a job that couldn't be enqueued.
+//
+// KEYS[1]: the batch
+// KEYS[2]: the JIDs of pending jobs
+// ARGV[1]: the JID of the job
+var batchRemoveScript = redis.NewScript(2, `
+if redis.call('srem', KEYS[2], ARGV[1]) == 1 then
+	redis.call('hincrby', KEYS[1], 'total', -1)
+	redis.call('hincrby', KEYS[1], 'pending', -1)
+end
+return 1
+`)
+
+// Records how a job of a batch ended, or commits the batch, then marks the
+// batch complete or successful if it now is and enqueues its callbacks. Only
+// pending jobs are counted, so a job that runs again after it succeeded
+// doesn't count twice.
+//
+// KEYS[1]: the batch
+// KEYS[2]: the JIDs of pending jobs
+// KEYS[3]: the JIDs of failed jobs
+// KEYS[4]: the set of queues
+// ARGV[1]: the JID of the job
+// ARGV[2]: "success", "failure" or "commit"
+// ARGV[3]: how long to keep the batch, in seconds
+// ARGV[4]: the current time
+// ARGV[5]: the prefix of queue keys
+var batchUpdateScript = redis.NewScript(4, `
+if redis.call('exists', KEYS[1]) == 0 then
+	return 0
+end
+if ARGV[2] == 'success' then
+	if redis.call('srem', KEYS[2], ARGV[1]) == 1 then
+		if redis.call('srem', KEYS[3], ARGV[1]) == 1 then
+			redis.call('hincrby', KEYS[1], 'failures', -1)
+		end
+		redis.call('hincrby', KEYS[1], 'pending', -1)
+	end
+elseif ARGV[2] == 'failure' then
+	if redis.call('sismember', KEYS[2], ARGV[1]) == 1 and redis.call('sadd', KEYS[3], ARGV[1]) == 1 then
+		redis.call('hincrby', KEYS[1], 'failures', 1)
+	end
+elseif ARGV[2] == 'commit' then
+	redis.call('hset', KEYS[1], 'committed', '1')
+end
+redis.call('expire', KEYS[1], ARGV[3])
+redis.call('expire', KEYS[2], ARGV[3])
+redis.call('expire', KEYS[3], ARGV[3])
+local batch = redis.call('hmget', KEYS[1], 'committed', 'pending', 'failures', 'completed_at', 'succeeded_at')
+if batch[1] ~= '1' then
+	return 0
+end
+local function fire(callback)
+	local queue = redis.call('hget', KEYS[1], callback .. '_queue')
+	if queue then
+		redis.call('sadd', KEYS[4], queue)
+		redis.call('rpush', ARGV[5] .. queue, redis.call('hget', KEYS[1], callback))
+	end
+end
+local pending = tonumber(batch[2]) or 0
+if pending == (tonumber(batch[3]) or 0) and not batch[4] then
+	redis.call('hset', KEYS[1], 'completed_at', ARGV[4])
+	fire('on_complete')
+end
+if pending == 0 and not batch[5] then
+	redis.call('hset', KEYS[1], 'succeeded_at', ARGV[4])
+	fire('on_success')
+end
+return 1
+`)
+
+func batchKey(config *config, bid string) string {
+	return config.NamespacedKey("batch", bid)
+}
+
+func batchPendingKey(config *config, bid string) string {
+	return config.NamespacedKey("batch", bid, "pending")
+}
+
+func batchFailedKey(config *config, bid string) string {
+	return config.NamespacedKey("batch", bid, "failed")
+}
+
+// NewBatch opens a batch. Its callbacks are only enqueued once it's
+// committed.
+func (w *Workers) NewBatch(description string) (*Batch, error) {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	batch := &Batch{generateJid(), w, nil, nil}
+	key := batchKey(w.config, batch.ID)
+
+	conn.Send("multi")
+	conn.Send("hmset", key,
+		"description", description,
+		"created_at", nowToSecondsWithNanoPrecision(),
+		"total", 0,
+		"pending", 0,
+		"failures", 0,
+	)
+	conn.Send("expire", key, batchTTL)
+	if _, err := conn.Do("exec"); err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+// Enqueue adds a job to the batch.
+func (b *Batch) Enqueue(queue, class string, args interface{}) (string, error) {
+	return b.EnqueueWithOptions(queue, class, args, EnqueueOptions{At: nowToSecondsWithNanoPrecision()})
+}
+
+// EnqueueWithOptions adds a job to the batch.
+func (b *Batch) EnqueueWithOptions(queue, class string, args interface{}, opts EnqueueOptions) (string, error) {
+	opts.BatchID = b.ID
+	return b.workers.EnqueueWithOptions(queue, class, args, opts)
+}
+
+// OnSuccess enqueues class with args on queue once every job of the batch
+// has succeeded. It must be called before Commit.
+func (b *Batch) OnSuccess(queue, class string, args interface{}) {
+	b.onSuccess = newBatchCallback(queue, class, args)
+}
+
+// OnComplete enqueues class with args on queue once every job of the batch
+// has succeeded or failed at least once. It must be called before Commit.
+func (b *Batch) OnComplete(queue, class string, args interface{}) {
+	b.onComplete = newBatchCallback(queue, class, args)
+}
+
+func newBatchCallback(queue, class string, args interface{}) *EnqueueData {
+	return &EnqueueData{
+		Queue:      queue,
+		Class:      class,
+		Args:       args,
+		Jid:        generateJid(),
+		EnqueuedAt: nowToSecondsWithNanoPrecision(),
+	}
+}
+
+// Commit registers the callbacks, and enqueues them if the jobs of the batch
+// are already done. Jobs may still be added once it's committed, as long as
+// some are pending.
+func (b *Batch) Commit() error {
+	config := b.workers.config
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{}.Add(batchKey(config, b.ID))
+
+	for field, callback := range map[string]*EnqueueData{"on_success": b.onSuccess, "on_complete": b.onComplete} {
+		if callback == nil {
+			continue
+		}
+
+		bytes, err := json.Marshal(callback)
+		if err != nil {
+			return err
+		}
+
+		args = args.Add(field, bytes, field+"_queue", callback.Queue)
+	}
+
+	if len(args) > 1 {
+		if _, err := conn.Do("hmset", args...); err != nil {
+			return err
+		}
+	}
+
+	return updateBatch(config, conn, b.ID, "", "commit")
+}
+
+// BatchStatus returns the counts of the batch bid.
+func (w *Workers) BatchStatus(bid string) (*BatchStatus, error) {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	conn.Send("hgetall", batchKey(w.config, bid))
+	conn.Send("smembers", batchFailedKey(w.config, bid))
+	conn.Flush()
+
+	batch, err := redis.StringMap(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+
+	failed, err := redis.Strings(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(batch) == 0 {
+		return nil, ErrBatchNotFound
+	}
+
+	status := &BatchStatus{ID: bid, Description: batch["description"], FailedJids: failed}
+	status.Total, _ = strconv.Atoi(batch["total"])
+	status.Pending, _ = strconv.Atoi(batch["pending"])
+	status.Failures, _ = strconv.Atoi(batch["failures"])
+	status.CreatedAt = parseTimestamp(batch["created_at"])
+	status.CompletedAt = parseTimestamp(batch["completed_at"])
+	status.SucceededAt = parseTimestamp(batch["succeeded_at"])
+
+	return status, nil
+}
+
+func parseTimestamp(seconds string) time.Time {
+	value, err := strconv.ParseFloat(seconds, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return secondsToTime(value)
+}
+
+func addToBatch(config *config, conn redis.Conn, bid, jid string) error {
+	added, err := redis.Bool(batchAddScript.Do(conn, batchKey(config, bid), batchPendingKey(config, bid), jid, batchTTL))
+	if err != nil {
+		return err
+	} else if !added {
+		return ErrBatchNotFound
+	}
+
+	return nil
+}
+
+func removeFromBatch(config *config, conn redis.Conn, bid, jid string) {
+	if _, err := batchRemoveScript.Do(conn, batchKey(config, bid), batchPendingKey(config, bid), jid); err != nil {
+		Logger.Println("ERR: ", err)
+	}
+}
+
+// updateBatch records outcome and enqueues the callbacks that are now due.
+func updateBatch(config *config, conn redis.Conn, bid, jid, outcome string) error {
+	_, err := batchUpdateScript.Do(
+		conn,
+		batchKey(config, bid),
+		batchPendingKey(config, bid),
+		batchFailedKey(config, bid),
+		config.NamespacedKey("queues"),
+		jid,
+		outcome,
+		batchTTL,
+		nowToSecondsWithNanoPrecision(),
+		config.NamespacedKey("queue", ""),
+	)
+
+	return err
+}
+
+// MiddlewareBatch records the outcome of jobs that belong to a batch.
+// Discarded jobs count as succeeded, cancelled ones as failed.
+type MiddlewareBatch struct {
+	config *config
+}
+
+func (b *MiddlewareBatch) Call(queue string, message *Msg, next func() error) error {
+	return b.CallContext(context.Background(), queue, message, func(context.Context) error {
+		return next()
+	})
+}
+
+func (b *MiddlewareBatch) CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+	err := next(ctx)
+
+	bid, _ := message.Get("bid").String()
+	if bid == "" {
+		return err
+	}
+
+	outcome := "success"
+	var discard *DiscardError
+	if err != nil && (!errors.As(err, &discard) || errors.Is(err, ErrJobCancelled)) {
+		outcome = "failure"
+	}
+
+	conn := b.config.Pool.Get()
+	defer conn.Close()
+
+	if updateErr := updateBatch(b.config, conn, bid, message.Jid(), outcome); updateErr != nil {
+		Logger.Println("ERR: couldn't update batch", bid, ":", updateErr)
+	}
+
+	return err
+}
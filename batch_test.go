@@ -0,0 +1,189 @@
+package workers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func BatchSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	w := mkWorkers(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	wares := NewMiddleware(&MiddlewareBatch{config})
+
+	// pops the messages enqueued on queue.
+	popAll := func(queue string) (messages []*Msg) {
+		for {
+			json, err := redis.String(conn.Do("lpop", "prod:queue:"+queue))
+			if err != nil {
+				return
+			}
+			message, _ := NewMsg(json)
+			messages = append(messages, message)
+		}
+	}
+
+	run := func(message *Msg, err error) {
+		wares.callContext(context.Background(), "batchqueue", message, func(context.Context) error {
+			return err
+		})
+	}
+
+	batch, _ := w.NewBatch("reports")
+	batch.OnComplete("callbacks", "Completed", []string{"done"})
+	batch.OnSuccess("callbacks", "Succeeded", nil)
+
+	c.Specify("counts the jobs enqueued into it", func() {
+		batch.Enqueue("batchqueue", "Chunk", []int{1})
+		w.EnqueueWithOptions("batchqueue", "Chunk", []int{2}, EnqueueOptions{BatchID: batch.ID})
+
+		status, err := w.BatchStatus(batch.ID)
+		c.Expect(err, IsNil)
+		c.Expect(status.Description, Equals, "reports")
+		c.Expect(status.Total, Equals, 2)
+		c.Expect(status.Pending, Equals, 2)
+		c.Expect(status.Failures, Equals, 0)
+
+		messages := popAll("batchqueue")
+		c.Expect(len(messages), Equals, 2)
+		c.Expect(messages[0].Get("bid").MustString(), Equals, batch.ID)
+	})
+
+	c.Specify("refuses jobs for unknown batches", func() {
+		_, err := w.EnqueueWithOptions("batchqueue", "Chunk", nil, EnqueueOptions{BatchID: "missing"})
+		c.Expect(err, Equals, ErrBatchNotFound)
+		c.Expect(len(popAll("batchqueue")), Equals, 0)
+	})
+
+	c.Specify("enqueues both callbacks once every job succeeded", func() {
+		batch.Enqueue("batchqueue", "Chunk", []int{1})
+		batch.Enqueue("batchqueue", "Chunk", []int{2})
+		c.Expect(batch.Commit(), IsNil)
+
+		messages := popAll("batchqueue")
+		run(messages[0], nil)
+		c.Expect(len(popAll("callbacks")), Equals, 0)
+
+		run(messages[1], nil)
+		callbacks := popAll("callbacks")
+		c.Expect(len(callbacks), Equals, 2)
+		c.Expect(callbacks[0].Get("class").MustString(), Equals, "Completed")
+		c.Expect(callbacks[0].Args().GetIndex(0).MustString(), Equals, "done")
+		c.Expect(callbacks[1].Get("class").MustString(), Equals, "Succeeded")
+
+		status, _ := w.BatchStatus(batch.ID)
+		c.Expect(status.Pending, Equals, 0)
+		c.Expect(status.CompletedAt.IsZero(), IsFalse)
+		c.Expect(status.SucceededAt.IsZero(), IsFalse)
+	})
+
+	c.Specify("enqueues only the completion callback when a job failed", func() {
+		batch.Enqueue("batchqueue", "Chunk", []int{1})
+		batch.Enqueue("batchqueue", "Chunk", []int{2})
+		batch.Commit()
+
+		messages := popAll("batchqueue")
+		run(messages[0], errors.New("boom"))
+		run(messages[0], errors.New("boom again"))
+		run(messages[1], nil)
+
+		callbacks := popAll("callbacks")
+		c.Expect(len(callbacks), Equals, 1)
+		c.Expect(callbacks[0].Get("class").MustString(), Equals, "Completed")
+
+		status, _ := w.BatchStatus(batch.ID)
+		c.Expect(status.Pending, Equals, 1)
+		c.Expect(status.Failures, Equals, 1)
+		c.Expect(status.FailedJids, Contains, messages[0].Jid())
+		c.Expect(status.SucceededAt.IsZero(), IsTrue)
+
+		c.Specify("and the success callback once it succeeds on retry", func() {
+			run(messages[0], nil)
+
+			callbacks := popAll("callbacks")
+			c.Expect(len(callbacks), Equals, 1)
+			c.Expect(callbacks[0].Get("class").MustString(), Equals, "Succeeded")
+
+			status, _ := w.BatchStatus(batch.ID)
+			c.Expect(status.Failures, Equals, 0)
+			c.Expect(len(status.FailedJids), Equals, 0)
+		})
+	})
+
+	c.Specify("counts a job that runs again after it succeeded once", func() {
+		batch.Enqueue("batchqueue", "Chunk", []int{1})
+		batch.Enqueue("batchqueue", "Chunk", []int{2})
+		batch.Commit()
+
+		messages := popAll("batchqueue")
+		run(messages[0], nil)
+		run(messages[0], nil)
+		run(messages[0], errors.New("boom"))
+		c.Expect(len(popAll("callbacks")), Equals, 0)
+
+		status, _ := w.BatchStatus(batch.ID)
+		c.Expect(status.Pending, Equals, 1)
+		c.Expect(status.Failures, Equals, 0)
+
+		run(messages[1], nil)
+		c.Expect(len(popAll("callbacks")), Equals, 2)
+	})
+
+	c.Specify("counts discarded jobs as succeeded", func() {
+		batch.Enqueue("batchqueue", "Chunk", nil)
+		batch.Commit()
+
+		run(popAll("batchqueue")[0], Discard(errors.New("stale")))
+
+		c.Expect(len(popAll("callbacks")), Equals, 2)
+	})
+
+	c.Specify("counts cancelled jobs as failed", func() {
+		batch.Enqueue("batchqueue", "Chunk", nil)
+		batch.Commit()
+
+		run(popAll("batchqueue")[0], Discard(ErrJobCancelled))
+
+		callbacks := popAll("callbacks")
+		c.Expect(len(callbacks), Equals, 1)
+		c.Expect(callbacks[0].Get("class").MustString(), Equals, "Completed")
+	})
+
+	c.Specify("waits for Commit before enqueuing callbacks", func() {
+		batch.Enqueue("batchqueue", "Chunk", nil)
+		run(popAll("batchqueue")[0], nil)
+		c.Expect(len(popAll("callbacks")), Equals, 0)
+
+		batch.Commit()
+		c.Expect(len(popAll("callbacks")), Equals, 2)
+
+		batch.Commit()
+		c.Expect(len(popAll("callbacks")), Equals, 0)
+	})
+
+	c.Specify("keeps jobs added by its jobs pending", func() {
+		batch.Enqueue("batchqueue", "Chunk", nil)
+		batch.Commit()
+
+		wares.callContext(context.Background(), "batchqueue", popAll("batchqueue")[0], func(context.Context) error {
+			_, err := batch.Enqueue("batchqueue", "Chunk", nil)
+			return err
+		})
+		c.Expect(len(popAll("callbacks")), Equals, 0)
+
+		run(popAll("batchqueue")[0], nil)
+		c.Expect(len(popAll("callbacks")), Equals, 2)
+	})
+
+	c.Specify("BatchStatus of an unknown batch", func() {
+		_, err := w.BatchStatus("missing")
+		c.Expect(err, Equals, ErrBatchNotFound)
+	})
+}
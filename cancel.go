@@ -0,0 +1,352 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// How long a cancelled JID is remembered, in seconds.
+	cancelledTTL = 24 * 60 * 60
+	// How many messages of a queue are searched at once.
+	cancelSearchBatch = 100
+
+	// The sorted set of cancelled JIDs, scored by when they were cancelled.
+	cancelledSet = "cancelled"
+	// The channel cancelled JIDs are published on.
+	cancelChannel = "cancel"
+)
+
+// ErrJobCancelled is the error of jobs stopped with Cancel.
+var ErrJobCancelled = errors.New("job cancelled")
+
+// Cancel stops the job jid. A job waiting in a queue, the scheduled set or
+// the retry set is removed. A running job has its context cancelled, which
+// its handler sees through ctx.Done() and Cancelled. Either way the job isn't
+// retried, and is recorded as cancelled. A job that isn't found is cancelled
+// should it start within a day.
+func (w *Workers) Cancel(jid string) error {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	// Published first, so a job fetched while we look for it won't run.
+	now := nowToSecondsWithNanoPrecision()
+	key := w.config.NamespacedKey(cancelledSet)
+
+	conn.Send("multi")
+	conn.Send("zadd", key, now, jid)
+	conn.Send("zremrangebyscore", key, "-inf", now-cancelledTTL)
+	conn.Send("publish", w.config.NamespacedKey(cancelChannel), jid)
+	if _, err := conn.Do("exec"); err != nil {
+		return err
+	}
+
+	// Heard at once by this process, even when it isn't listening.
+	w.config.cancellations.cancel(jid, now)
+
+	for _, set := range []string{w.config.scheduledJobsQueue, w.config.retryQueue} {
+		key := w.config.NamespacedKey(set)
+
+		member, err := findInSortedSet(conn, key, jid)
+		if err == ErrJobNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if removed, err := redis.Int(conn.Do("zrem", key, member)); err != nil {
+			return err
+		} else if removed > 0 {
+			cancelRemoved(w.config, conn, member)
+			return nil
+		}
+	}
+
+	queues, err := redis.Strings(conn.Do("smembers", w.config.NamespacedKey("queues")))
+	if err != nil {
+		return err
+	}
+
+	for _, queue := range queues {
+		member, err := removeFromList(conn, w.config.NamespacedKey("queue", queue), jid)
+		if err == ErrJobNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		cancelRemoved(w.config, conn, member)
+		return nil
+	}
+
+	return nil
+}
+
+// removeFromList removes the message with the given JID from a list, and
+// returns it, or ErrJobNotFound.
+func removeFromList(conn redis.Conn, key, jid string) (string, error) {
+	for start := 0; ; start += cancelSearchBatch {
+		members, err := redis.Strings(conn.Do("lrange", key, start, start+cancelSearchBatch-1))
+		if err != nil {
+			return "", err
+		}
+
+		for _, member := range members {
+			if message, err := NewMsg(member); err == nil && message.Jid() == jid {
+				removed, err := redis.Int(conn.Do("lrem", key, 1, member))
+				if err != nil {
+					return "", err
+				} else if removed == 0 {
+					// Fetched in the meantime, the cancellation stops it.
+					return "", ErrJobNotFound
+				}
+				return member, nil
+			}
+		}
+
+		if len(members) < cancelSearchBatch {
+			return "", ErrJobNotFound
+		}
+	}
+}
+
+// cancelRemoved records that a job was cancelled before it ran, releases its
+// unique lock, and fails it in its batch or workflow.
+func cancelRemoved(config *config, conn redis.Conn, member string) {
+	message, err := NewMsg(member)
+	if err != nil {
+		Logger.Println("ERR: ", err)
+		return
+	}
+
+	recordJobStatus(config, conn, message.Jid(), JobCancelled,
+		"error", ErrJobCancelled.Error(),
+		"finished_at", nowToSecondsWithNanoPrecision(),
+	)
+
+	if mode, _ := message.Get("unique").String(); UniqueMode(mode) != UniqueUntilExpired {
+		releaseUnique(config, message)
+	}
+
+	if bid, _ := message.Get("bid").String(); bid != "" {
+		if err := updateBatch(config, conn, bid, message.Jid(), "failure"); err != nil {
+			Logger.Println("ERR: couldn't update batch", bid, ":", err)
+		}
+	}
+
+	if id, _ := message.Get("workflow").String(); id != "" {
+		node, _ := message.Get("node").String()
+		workflowNodeDone(config, conn, id, node, "failure", []byte("null"))
+	}
+}
+
+// cancellation records whether the running job was cancelled.
+type cancellation struct {
+	cancelled int32
+	cancel    context.CancelFunc
+}
+
+func (c *cancellation) stop() {
+	atomic.StoreInt32(&c.cancelled, 1)
+	c.cancel()
+}
+
+type cancellationKey struct{}
+
+// Cancelled reports whether the running job was cancelled with Cancel.
+func Cancelled(ctx context.Context) bool {
+	c, ok := ctx.Value(cancellationKey{}).(*cancellation)
+	return ok && atomic.LoadInt32(&c.cancelled) == 1
+}
+
+// cancellations holds the jobs running in this process, and the JIDs it heard
+// were cancelled, so jobs are stopped without asking Redis.
+type cancellations struct {
+	sync.Mutex
+	running   map[string]*cancellation
+	cancelled map[string]float64
+}
+
+func newCancellations() *cancellations {
+	return &cancellations{running: make(map[string]*cancellation), cancelled: make(map[string]float64)}
+}
+
+// cancel records that jid was cancelled at the given time, and stops it if
+// it's running.
+func (c *cancellations) cancel(jid string, at float64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.cancelled[jid]; !ok {
+		expired := nowToSecondsWithNanoPrecision() - cancelledTTL
+		for cancelled, when := range c.cancelled {
+			if when < expired {
+				delete(c.cancelled, cancelled)
+			}
+		}
+	}
+	c.cancelled[jid] = at
+
+	if job, ok := c.running[jid]; ok {
+		job.stop()
+	}
+}
+
+// start registers job as running jid. It returns false, without registering
+// it, if jid was cancelled.
+func (c *cancellations) start(jid string, job *cancellation) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.cancelled[jid]; ok {
+		return false
+	}
+
+	c.running[jid] = job
+	return true
+}
+
+func (c *cancellations) finish(jid string, job *cancellation) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.running[jid] == job {
+		delete(c.running, jid)
+	}
+}
+
+// cancelListener passes the JIDs cancelled by any process on to this one's
+// cancellations.
+type cancelListener struct {
+	config *config
+	closed chan bool
+}
+
+func newCancelListener(config *config) *cancelListener {
+	return &cancelListener{config, make(chan bool)}
+}
+
+func (l *cancelListener) start() {
+	go l.listen()
+}
+
+func (l *cancelListener) quit() {
+	close(l.closed)
+}
+
+func (l *cancelListener) listen() {
+	for {
+		if l.config.Pool.Dial == nil {
+			Logger.Println("ERR: the redis pool has no Dial func, jobs cancelled by other processes won't be stopped here.")
+			return
+		}
+
+		if conn, err := l.config.Pool.Dial(); err != nil {
+			Logger.Println("ERR: ", err)
+		} else {
+			l.receive(conn)
+		}
+
+		select {
+		case <-l.closed:
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+func (l *cancelListener) receive(conn redis.Conn) {
+	done := make(chan bool)
+	defer close(done)
+
+	// Closing the connection interrupts Receive.
+	go (func() {
+		select {
+		case <-l.closed:
+		case <-done:
+		}
+		conn.Close()
+	})()
+
+	pubsub := redis.PubSubConn{Conn: conn}
+	if err := pubsub.Subscribe(l.config.NamespacedKey(cancelChannel)); err != nil {
+		Logger.Println("ERR: ", err)
+		return
+	}
+
+	for {
+		switch reply := pubsub.Receive().(type) {
+		case redis.Subscription:
+			// Catch up on what was cancelled while we weren't subscribed.
+			l.load()
+		case redis.Message:
+			l.config.cancellations.cancel(string(reply.Data), nowToSecondsWithNanoPrecision())
+		case error:
+			select {
+			case <-l.closed:
+			default:
+				Logger.Println("ERR: ", reply)
+			}
+			return
+		}
+	}
+}
+
+// load records the JIDs cancelled in the last cancelledTTL seconds.
+func (l *cancelListener) load() {
+	conn := l.config.Pool.Get()
+	defer conn.Close()
+
+	since := nowToSecondsWithNanoPrecision() - cancelledTTL
+
+	reply, err := redis.Strings(conn.Do("zrangebyscore", l.config.NamespacedKey(cancelledSet), since, "+inf", "withscores"))
+	if err != nil {
+		Logger.Println("ERR: ", err)
+		return
+	}
+
+	for i := 0; i+1 < len(reply); i += 2 {
+		at, _ := strconv.ParseFloat(reply[i+1], 64)
+		l.config.cancellations.cancel(reply[i], at)
+	}
+}
+
+// MiddlewareCancel skips jobs cancelled before they started, and cancels the
+// context of running jobs once they're cancelled. Either way the job ends
+// with a discarded ErrJobCancelled, so it isn't retried. It learns of
+// cancellations from Cancel in this process, and from other processes while
+// Workers is started.
+type MiddlewareCancel struct {
+	config *config
+}
+
+func (m *MiddlewareCancel) Call(queue string, message *Msg, next func() error) error {
+	return m.CallContext(context.Background(), queue, message, func(context.Context) error {
+		return next()
+	})
+}
+
+func (m *MiddlewareCancel) CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	job := &cancellation{0, cancel}
+	if !m.config.cancellations.start(message.Jid(), job) {
+		return Discard(ErrJobCancelled)
+	}
+	defer m.config.cancellations.finish(message.Jid(), job)
+
+	err := next(context.WithValue(ctx, cancellationKey{}, job))
+
+	if atomic.LoadInt32(&job.cancelled) == 1 {
+		return Discard(ErrJobCancelled)
+	}
+
+	return err
+}
@@ -0,0 +1,200 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func CancelSpec(c gospec.Context) {
+	config, _ := mkConfig(ConfigureOpts{
+		RedisURL:     redisURL(),
+		ProcessID:    "1",
+		Namespace:    "prod",
+		JobStatusTTL: 3600,
+	})
+	w := mkWorkers(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	count := func(command, key string) int {
+		n, _ := redis.Int(conn.Do(command, key))
+		return n
+	}
+
+	c.Specify("Cancel", func() {
+		c.Specify("removes a job from its queue", func() {
+			jid, _ := w.Enqueue("cancelqueue", "Export", []int{1})
+			w.Enqueue("cancelqueue", "Export", []int{2})
+
+			c.Expect(w.Cancel(jid), IsNil)
+			c.Expect(count("llen", "prod:queue:cancelqueue"), Equals, 1)
+
+			status, _ := w.JobStatus(jid)
+			c.Expect(status.State, Equals, JobCancelled)
+		})
+
+		c.Specify("removes a scheduled job", func() {
+			jid, _ := w.EnqueueIn("cancelqueue", "Export", 60, nil)
+
+			c.Expect(w.Cancel(jid), IsNil)
+			c.Expect(count("zcard", "prod:"+config.scheduledJobsQueue), Equals, 0)
+		})
+
+		c.Specify("removes a job waiting to be retried", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"class\":\"Export\",\"args\":[],\"retry\":true,\"retry_count\":1}")
+			conn.Do("zadd", "prod:"+config.retryQueue, nowToSecondsWithNanoPrecision()+60, message.ToJson())
+
+			c.Expect(w.Cancel("2"), IsNil)
+			c.Expect(count("zcard", "prod:"+config.retryQueue), Equals, 0)
+		})
+
+		c.Specify("releases the lock of a unique job", func() {
+			jid, _ := w.EnqueueWithOptions("cancelqueue", "Export", []int{1}, EnqueueOptions{Unique: UniqueUntilExecuted})
+			w.Cancel(jid)
+
+			again, _ := w.EnqueueWithOptions("cancelqueue", "Export", []int{1}, EnqueueOptions{Unique: UniqueUntilExecuted})
+			c.Expect(again, Not(Equals), jid)
+		})
+
+		c.Specify("counts a job of a batch as failed", func() {
+			batch, _ := w.NewBatch("exports")
+			jid, _ := batch.Enqueue("cancelqueue", "Export", nil)
+			batch.Commit()
+
+			w.Cancel(jid)
+
+			status, _ := w.BatchStatus(batch.ID)
+			c.Expect(status.Pending, Equals, 1)
+			c.Expect(status.FailedJids, Contains, jid)
+			c.Expect(status.SucceededAt.IsZero(), IsTrue)
+			c.Expect(status.CompletedAt.IsZero(), IsFalse)
+		})
+
+		c.Specify("records the job as cancelled", func() {
+			w.Cancel("3")
+
+			_, err := redis.Float64(conn.Do("zscore", "prod:cancelled", "3"))
+			c.Expect(err, IsNil)
+		})
+	})
+
+	c.Specify("cancelListener", func() {
+		other, _ := mkConfig(ConfigureOpts{
+			RedisURL:  redisURL(),
+			ProcessID: "2",
+			Namespace: "prod",
+		})
+
+		listener := newCancelListener(other)
+		defer listener.quit()
+
+		stopped := func(jid string) bool {
+			job := &cancellation{0, func() {}}
+			if !other.cancellations.start(jid, job) {
+				return true
+			}
+			other.cancellations.finish(jid, job)
+			return false
+		}
+
+		eventually := func(jid string) bool {
+			for i := 0; i < 100; i++ {
+				if stopped(jid) {
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+
+		c.Specify("hears of jobs cancelled by other processes", func() {
+			listener.start()
+			time.Sleep(50 * time.Millisecond)
+
+			w.Cancel("4")
+			c.Expect(eventually("4"), IsTrue)
+			c.Expect(stopped("5"), IsFalse)
+		})
+
+		c.Specify("catches up on jobs cancelled before it listened", func() {
+			w.Cancel("4")
+
+			listener.start()
+			c.Expect(eventually("4"), IsTrue)
+		})
+	})
+
+	c.Specify("MiddlewareCancel", func() {
+		wares := NewMiddleware(&MiddlewareCancel{config})
+		message, _ := NewMsg("{\"jid\":\"2\",\"class\":\"Export\",\"args\":[],\"retry\":true}")
+
+		c.Specify("skips jobs cancelled before they started", func() {
+			w.Cancel("2")
+
+			ran := false
+			err := wares.callContext(context.Background(), "cancelqueue", message, func(context.Context) error {
+				ran = true
+				return nil
+			})
+
+			c.Expect(ran, IsFalse)
+			c.Expect(errors.Is(err, ErrJobCancelled), IsTrue)
+		})
+
+		c.Specify("cancels the context of running jobs", func() {
+			started := make(chan bool)
+			result := make(chan error)
+
+			go (func() {
+				result <- wares.callContext(context.Background(), "cancelqueue", message, func(ctx context.Context) error {
+					close(started)
+
+					select {
+					case <-ctx.Done():
+						c.Expect(Cancelled(ctx), IsTrue)
+						return ctx.Err()
+					case <-time.After(5 * time.Second):
+						return nil
+					}
+				})
+			})()
+
+			<-started
+			w.Cancel("2")
+
+			err := <-result
+			c.Expect(errors.Is(err, ErrJobCancelled), IsTrue)
+		})
+
+		c.Specify("isn't retried", func() {
+			w.Cancel("2")
+
+			wares := NewMiddleware(&MiddlewareRetry{config}, &MiddlewareStatus{config}, &MiddlewareCancel{config})
+			err := wares.callContext(context.Background(), "cancelqueue", message, func(context.Context) error {
+				return nil
+			})
+
+			c.Expect(err, IsNil)
+			c.Expect(count("zcard", "prod:"+config.retryQueue), Equals, 0)
+
+			status, _ := w.JobStatus("2")
+			c.Expect(status.State, Equals, JobCancelled)
+		})
+
+		c.Specify("runs other jobs", func() {
+			c.Expect(Cancelled(context.Background()), IsFalse)
+
+			err := wares.callContext(context.Background(), "cancelqueue", message, func(ctx context.Context) error {
+				c.Expect(Cancelled(ctx), IsFalse)
+				return nil
+			})
+			c.Expect(err, IsNil)
+		})
+	})
+}
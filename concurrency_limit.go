@@ -0,0 +1,226 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	defaultConcurrencyLease = 60 * time.Second
+	defaultConcurrencyDelay = 5 * time.Second
+)
+
+// ConcurrencyLimit caps how many jobs run at once across every process. Each
+// running job holds a slot, leased so that a crashed process's slots free
+// themselves.
+type ConcurrencyLimit struct {
+	// Name identifies the slots, letting several classes share them. Defaults
+	// to the class.
+	Name string
+	// Limit is how many jobs may run at once, at least one.
+	Limit int
+	// Key, when set, gives each key its own Limit slots, e.g. an account id
+	// taken from the args.
+	Key func(args *Args) string
+	// Lease is how long a slot is kept when its process stops renewing it,
+	// 60 seconds by default.
+	Lease time.Duration
+	// Delay is how long a job that couldn't get a slot waits before it's
+	// tried again, 5 seconds by default with some jitter.
+	Delay time.Duration
+}
+
+// Takes a slot unless they're all held by unexpired leases. Returns whether
+// it did.
+//
+// KEYS[1]: the slots, scored by lease expiry
+// ARGV[1]: the limit
+// ARGV[2]: the current time
+// ARGV[3]: the expiry of the new lease
+// ARGV[4]: the holder of the new lease
+var acquireSlotScript = redis.NewScript(1, `
+redis.call('zremrangebyscore', KEYS[1], '-inf', ARGV[2])
+if redis.call('zcard', KEYS[1]) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('zadd', KEYS[1], ARGV[3], ARGV[4])
+return 1
+`)
+
+// Renews a lease, if it's still held.
+//
+// KEYS[1]: the slots
+// ARGV[1]: the new expiry
+// ARGV[2]: the holder
+var renewSlotScript = redis.NewScript(1, `
+if redis.call('zscore', KEYS[1], ARGV[2]) then
+	redis.call('zadd', KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// concurrencyLimits holds the limits registered per job class.
+type concurrencyLimits struct {
+	sync.RWMutex
+	byClass map[string]*ConcurrencyLimit
+}
+
+// SetConcurrencyLimit caps how many jobs of class run at once across every
+// process. Jobs that can't get a slot are rescheduled without counting as
+// failed or retried.
+func (w *Workers) SetConcurrencyLimit(class string, limit ConcurrencyLimit) error {
+	if limit.Limit <= 0 {
+		return fmt.Errorf("invalid concurrency limit %d for %s", limit.Limit, class)
+	}
+	if limit.Name == "" {
+		limit.Name = class
+	}
+	if limit.Lease <= 0 {
+		limit.Lease = defaultConcurrencyLease
+	}
+
+	w.config.concurrencyLimits.Lock()
+	defer w.config.concurrencyLimits.Unlock()
+
+	w.config.concurrencyLimits.byClass[class] = &limit
+	return nil
+}
+
+func (c *config) concurrencyLimitFor(message *Msg) *ConcurrencyLimit {
+	class, err := message.Get("class").String()
+	if err != nil {
+		return nil
+	}
+
+	c.concurrencyLimits.RLock()
+	defer c.concurrencyLimits.RUnlock()
+
+	return c.concurrencyLimits.byClass[class]
+}
+
+// slotsKey is the sorted set of the slots message competes for.
+func (l *ConcurrencyLimit) slotsKey(config *config, message *Msg) string {
+	if l.Key != nil {
+		return config.NamespacedKey("concurrency", l.Name, l.Key(message.Args()))
+	}
+
+	return config.NamespacedKey("concurrency", l.Name)
+}
+
+func (l *ConcurrencyLimit) delay() time.Duration {
+	if l.Delay > 0 {
+		return l.Delay
+	}
+
+	return withJitter(defaultConcurrencyDelay, 0.5)
+}
+
+// acquire takes a slot for holder. It returns false when there's none free.
+func (l *ConcurrencyLimit) acquire(config *config, slots, holder string) (bool, error) {
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	now := nowToSecondsWithNanoPrecision()
+	expiry := now + durationToSecondsWithNanoPrecision(l.Lease)
+
+	return redis.Bool(acquireSlotScript.Do(conn, slots, l.Limit, now, expiry, holder))
+}
+
+// hold keeps renewing the lease of holder until release is called, which
+// frees the slot.
+func (l *ConcurrencyLimit) hold(config *config, slots, holder string) (release func()) {
+	done := make(chan bool)
+	exit := make(chan bool)
+
+	go (func() {
+		defer close(exit)
+
+		ticker := time.NewTicker(l.Lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				l.renew(config, slots, holder)
+			}
+		}
+	})()
+
+	return func() {
+		close(done)
+		<-exit
+
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		if _, err := conn.Do("zrem", slots, holder); err != nil {
+			Logger.Println("ERR: couldn't release concurrency slot", holder, ":", err)
+		}
+	}
+}
+
+func (l *ConcurrencyLimit) renew(config *config, slots, holder string) {
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	expiry := nowToSecondsWithNanoPrecision() + durationToSecondsWithNanoPrecision(l.Lease)
+
+	renewed, err := redis.Bool(renewSlotScript.Do(conn, slots, expiry, holder))
+	if err != nil {
+		Logger.Println("ERR: ", err)
+	} else if !renewed {
+		Logger.Println("concurrency slot", holder, "expired before it could be renewed, the limit may be exceeded.")
+	}
+}
+
+// MiddlewareConcurrency runs jobs of classes with a concurrency limit only
+// once they hold a slot. Jobs that can't get one are rescheduled, without
+// counting as processed, failed or retried.
+type MiddlewareConcurrency struct {
+	config *config
+}
+
+func (m *MiddlewareConcurrency) Call(queue string, message *Msg, next func() error) error {
+	return m.CallContext(context.Background(), queue, message, func(context.Context) error {
+		return next()
+	})
+}
+
+func (m *MiddlewareConcurrency) CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+	limit := m.config.concurrencyLimitFor(message)
+	if limit == nil {
+		return next(ctx)
+	}
+
+	slots := limit.slotsKey(m.config, message)
+	holder := m.config.processId + ":" + message.Jid() + ":" + generateJid()[:8]
+
+	acquired, err := limit.acquire(m.config, slots, holder)
+	if err != nil {
+		// Better to exceed the limit than to stop processing.
+		Logger.Println("ERR: couldn't acquire concurrency slot:", err)
+		return next(ctx)
+	}
+
+	if !acquired {
+		conn := m.config.Pool.Get()
+		defer conn.Close()
+
+		message.Set("queue", queue)
+		at := nowToSecondsWithNanoPrecision() + durationToSecondsWithNanoPrecision(limit.delay())
+		return scheduleMessage(m.config, conn, m.config.scheduledJobsQueue, at, []byte(message.ToJson()))
+	}
+
+	// A job that timed out keeps its slot until it actually returns.
+	ctx, exit := withJobExit(ctx)
+	defer exit.after(limit.hold(m.config, slots, holder))
+
+	return next(ctx)
+}
@@ -0,0 +1,167 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func ConcurrencyLimitSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	w := mkWorkers(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	wares := NewMiddleware(&MiddlewareConcurrency{config})
+
+	message := func(jid string) *Msg {
+		msg, _ := NewMsg("{\"jid\":\"" + jid + "\",\"class\":\"Report\",\"args\":[]}")
+		return msg
+	}
+
+	slotsHeld := func(key string) int {
+		count, _ := redis.Int(conn.Do("zcard", "prod:concurrency:"+key))
+		return count
+	}
+
+	scheduled := func() int {
+		count, _ := redis.Int(conn.Do("zcard", "prod:"+config.scheduledJobsQueue))
+		return count
+	}
+
+	// runs message in the background until the returned func is called.
+	running := func(msg *Msg) (finish func()) {
+		started := make(chan bool)
+		done := make(chan bool)
+		exit := make(chan bool)
+
+		go (func() {
+			defer close(exit)
+			wares.callContext(context.Background(), "concurrencyqueue", msg, func(context.Context) error {
+				close(started)
+				<-done
+				return nil
+			})
+		})()
+
+		select {
+		case <-started:
+		case <-exit:
+		}
+
+		return func() {
+			close(done)
+			<-exit
+		}
+	}
+
+	c.Specify("runs jobs without a limit", func() {
+		ran := false
+		wares.callContext(context.Background(), "concurrencyqueue", message("1"), func(context.Context) error {
+			ran = true
+			return nil
+		})
+		c.Expect(ran, IsTrue)
+	})
+
+	c.Specify("holds a slot while the job runs", func() {
+		w.SetConcurrencyLimit("Report", ConcurrencyLimit{Limit: 2})
+
+		finish := running(message("1"))
+		c.Expect(slotsHeld("Report"), Equals, 1)
+
+		finish()
+		c.Expect(slotsHeld("Report"), Equals, 0)
+	})
+
+	c.Specify("rejects limits below one", func() {
+		c.Expect(w.SetConcurrencyLimit("Report", ConcurrencyLimit{Limit: 0}), Not(IsNil))
+		c.Expect(config.concurrencyLimitFor(message("1")), IsNil)
+	})
+
+	c.Specify("keeps the slot of a job that timed out until it returns", func() {
+		w.SetConcurrencyLimit("Report", ConcurrencyLimit{Limit: 1})
+
+		hang := make(chan bool)
+		err := wares.callContext(context.Background(), "concurrencyqueue", message("1"), func(ctx context.Context) error {
+			return runWithTimeout(ctx, 10*time.Millisecond, message("1"), func(context.Context, *Msg) error {
+				<-hang
+				return nil
+			})
+		})
+		c.Expect(errors.Is(err, ErrJobTimeout), IsTrue)
+		c.Expect(slotsHeld("Report"), Equals, 1)
+
+		close(hang)
+		time.Sleep(50 * time.Millisecond)
+		c.Expect(slotsHeld("Report"), Equals, 0)
+	})
+
+	c.Specify("reschedules jobs when every slot is held", func() {
+		w.SetConcurrencyLimit("Report", ConcurrencyLimit{Limit: 1, Delay: time.Second})
+
+		finish := running(message("1"))
+		defer finish()
+
+		ran := false
+		err := wares.callContext(context.Background(), "concurrencyqueue", message("2"), func(context.Context) error {
+			ran = true
+			return nil
+		})
+		c.Expect(err, IsNil)
+		c.Expect(ran, IsFalse)
+		c.Expect(scheduled(), Equals, 1)
+
+		rescheduled, _ := redis.Strings(conn.Do("zrange", "prod:"+config.scheduledJobsQueue, 0, -1, "withscores"))
+		msg, _ := NewMsg(rescheduled[0])
+		c.Expect(msg.Get("queue").MustString(), Equals, "concurrencyqueue")
+		c.Expect(msg.Get("retry_count").Interface(), IsNil)
+	})
+
+	c.Specify("limits each key separately", func() {
+		w.SetConcurrencyLimit("Report", ConcurrencyLimit{Limit: 1, Key: func(args *Args) string {
+			return args.GetIndex(0).MustString()
+		}})
+
+		msg, _ := NewMsg("{\"jid\":\"1\",\"class\":\"Report\",\"args\":[\"a\"]}")
+		finish := running(msg)
+		defer finish()
+
+		other, _ := NewMsg("{\"jid\":\"2\",\"class\":\"Report\",\"args\":[\"b\"]}")
+		otherFinish := running(other)
+		defer otherFinish()
+
+		c.Expect(slotsHeld("Report:a"), Equals, 1)
+		c.Expect(slotsHeld("Report:b"), Equals, 1)
+		c.Expect(scheduled(), Equals, 0)
+	})
+
+	c.Specify("frees slots whose lease expired", func() {
+		w.SetConcurrencyLimit("Report", ConcurrencyLimit{Limit: 1})
+		conn.Do("zadd", "prod:concurrency:Report", nowToSecondsWithNanoPrecision()-1, "crashed")
+
+		finish := running(message("1"))
+		defer finish()
+
+		c.Expect(scheduled(), Equals, 0)
+		c.Expect(slotsHeld("Report"), Equals, 1)
+	})
+
+	c.Specify("renews the lease while the job runs", func() {
+		w.SetConcurrencyLimit("Report", ConcurrencyLimit{Limit: 1, Lease: 300 * time.Millisecond})
+
+		finish := running(message("1"))
+		defer finish()
+
+		time.Sleep(500 * time.Millisecond)
+
+		c.Expect(slotsHeld("Report"), Equals, 1)
+		slots, _ := redis.Strings(conn.Do("zrangebyscore", "prod:concurrency:Report", nowToSecondsWithNanoPrecision(), "+inf"))
+		c.Expect(len(slots), Equals, 1)
+	})
+}
@@ -2,6 +2,8 @@ package workers
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"strings"
 	"time"
 
@@ -19,34 +21,95 @@ type ConfigureOpts struct {
 	RedisURL string
 
 	// ProcessID uniquely identifies this process. Used for uncoordinated reliable processing of messages.
+	// Optional with a VisibilityTimeout, a random one is used when it's empty.
 	ProcessID string
 
+	// VisibilityTimeout switches single queues to leased fetching: fetched
+	// messages are leased for this many seconds, extended while their job
+	// runs, and put back on the queue by the reaper of any process within a
+	// minute of the lease expiring. This doesn't depend on a stable ProcessID. Zero keeps the per-process
+	// inprogress lists. Queues processed with ProcessQueues always use them.
+	VisibilityTimeout int
+
+	// Prefetch is how many messages a queue's fetcher moves into its
+	// inprogress list and buffers at once. Acknowledgements are then flushed
+	// in batches of the same size. Values below 2 fetch one message at a
+	// time. Not used with a VisibilityTimeout or by ProcessQueues.
+	Prefetch int
+
 	// MaxIdle is the maximum number of idle connections to keep in the redis connection pool.
 	MaxIdle int
 
 	// PoolSize is the maximum number of connections allowed by the redis conneciton pool.
 	PoolSize int
 
-	// PollInterval is how often we should poll for scheduled jobs.
+	// PollInterval is how often we should poll for scheduled jobs. Each
+	// process polls at a random interval averaging PollInterval times the
+	// number of live processes, so the fleet as a whole polls about every
+	// PollInterval.
+	// Jobs scheduled or retried sooner than that are enqueued when they're
+	// due.
 	PollInterval int
 
+	// SinglePoller elects one process to poll for scheduled jobs, every
+	// PollInterval. Another process takes over if it stops.
+	SinglePoller bool
+
 	// Namespace is the namespace to use for redis keys.
 	Namespace string
 
+	// JobStatusTTL records the status of every job, queryable with
+	// JobStatus for this many seconds after it last changed. Zero doesn't
+	// record statuses.
+	JobStatusTTL int
+
+	// RetryPolicy decides the delay between retries and when to give up, for
+	// jobs whose queue or class has no policy of its own. Defaults to
+	// DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
+	// DeadMaxJobs is how many jobs the dead set keeps, 10000 by default.
+	DeadMaxJobs int
+
+	// DeadTimeout is how many seconds jobs stay in the dead set, 180 days by
+	// default.
+	DeadTimeout int
+
+	// ShutdownTimeout is how many seconds Quit waits for running jobs to
+	// finish. Jobs still running after that are put back on their queue.
+	// Zero waits forever.
+	ShutdownTimeout int
+
 	RedisPool *redis.Pool
 }
 
 type config struct {
 	processId          string
+	identity           string
 	PollInterval       int
+	SinglePoller       bool
+	VisibilityTimeout  int
+	Prefetch           int
+	ShutdownTimeout    int
+	DeadMaxJobs        int
+	DeadTimeout        int
+	JobStatusTTL       int
 	Pool               *redis.Pool
 	Fetch              func(queue string) Fetcher
+	FetchQueues        func(queues []WeightedQueue, order QueueOrder) Fetcher
 	GlobalMiddlewares  *Middlewares
+	RetryPolicy        RetryPolicy
 	namespace          string
 	namespaceWithColon string
 
 	retryQueue         string
 	scheduledJobsQueue string
+	deadSet            string
+
+	retryPolicies     *retryPolicies
+	rateLimiters      *rateLimiters
+	concurrencyLimits *concurrencyLimits
+	cancellations     *cancellations
 }
 
 func Configure(cfg ConfigureOpts) (configObj *config, err error) {
@@ -61,6 +124,10 @@ func Configure(cfg ConfigureOpts) (configObj *config, err error) {
 		}
 	}
 
+	if cfg.ProcessID == "" && cfg.VisibilityTimeout > 0 {
+		cfg.ProcessID = processIdentity()
+	}
+
 	if cfg.ProcessID == "" {
 		err = errors.New("workers.Configure requires ProcessID to uniquely identify this worker process.")
 		return
@@ -70,12 +137,34 @@ func Configure(cfg ConfigureOpts) (configObj *config, err error) {
 		cfg.PollInterval = 15
 	}
 
+	if cfg.DeadMaxJobs == 0 {
+		cfg.DeadMaxJobs = defaultDeadMaxJobs
+	}
+
+	if cfg.DeadTimeout == 0 {
+		cfg.DeadTimeout = defaultDeadTimeout
+	}
+
 	configObj = &config{
 		processId:          cfg.ProcessID,
+		identity:           processIdentity(),
 		PollInterval:       cfg.PollInterval,
+		SinglePoller:       cfg.SinglePoller,
+		VisibilityTimeout:  cfg.VisibilityTimeout,
+		Prefetch:           cfg.Prefetch,
+		ShutdownTimeout:    cfg.ShutdownTimeout,
+		DeadMaxJobs:        cfg.DeadMaxJobs,
+		DeadTimeout:        cfg.DeadTimeout,
+		JobStatusTTL:       cfg.JobStatusTTL,
 		Pool:               redisPool,
 		retryQueue:         defaultRetryQueue,
 		scheduledJobsQueue: defaultScheduledJobsQueue,
+		deadSet:            defaultDeadSet,
+		RetryPolicy:        cfg.RetryPolicy,
+		retryPolicies:      &retryPolicies{byClass: make(map[string]RetryPolicy)},
+		rateLimiters:       &rateLimiters{byClass: make(map[string]RateLimiter)},
+		concurrencyLimits:  &concurrencyLimits{byClass: make(map[string]*ConcurrencyLimit)},
+		cancellations:      newCancellations(),
 	}
 
 	configObj.SetNamespace(cfg.Namespace)
@@ -84,12 +173,31 @@ func Configure(cfg ConfigureOpts) (configObj *config, err error) {
 
 	// closes over configObj
 	configObj.Fetch = func(queue string) Fetcher {
+		if configObj.VisibilityTimeout > 0 {
+			timeout := time.Duration(configObj.VisibilityTimeout) * time.Second
+			return NewLeaseFetch(configObj, queue, timeout, make(chan *Msg), make(chan bool))
+		}
+		if configObj.Prefetch > 1 {
+			return NewPrefetch(configObj, queue, configObj.Prefetch, make(chan *Msg), make(chan bool))
+		}
 		return NewFetch(configObj, queue, make(chan *Msg), make(chan bool))
 	}
 
+	configObj.FetchQueues = func(queues []WeightedQueue, order QueueOrder) Fetcher {
+		return NewMultiFetch(configObj, queues, order, make(chan *Msg), make(chan bool))
+	}
+
 	return
 }
 
+// processIdentity returns a unique hostname:pid:nonce identity, the way
+// Sidekiq identifies processes. It also identifies a process that wasn't
+// given a ProcessID.
+func processIdentity() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), generateJid()[:12])
+}
+
 func initRedisPool(cfg ConfigureOpts) (redisPool *redis.Pool, err error) {
 	if cfg.RedisURL == "" {
 		err = errors.New("workers.Configure requires RedisURL to connect to redis.")
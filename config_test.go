@@ -61,6 +61,17 @@ func ConfigSpec(c gospec.Context) {
 			c.Expect(config.PollInterval, Equals, 1)
 			c.Expect(err, IsNil)
 		})
+
+		c.Specify("allows a shutdown timeout", func() {
+			config, err := mkConfig(ConfigureOpts{
+				RedisURL:        "redis://localhost:6379",
+				ProcessID:       "1",
+				ShutdownTimeout: 30,
+			})
+
+			c.Expect(config.ShutdownTimeout, Equals, 30)
+			c.Expect(err, IsNil)
+		})
 	})
 
 	c.Specify("NamespacedKey", func() {
@@ -0,0 +1,66 @@
+package workers
+
+import (
+	"context"
+)
+
+// ContextJobFunc is a job handler that receives a context. The context is
+// cancelled when the workers start shutting down and carries the job's
+// metadata, see JobFromContext.
+type ContextJobFunc func(ctx context.Context, message *Msg) error
+
+// ContextAction is a middleware that receives the job's context and can pass
+// a derived one down the chain. Middlewares implementing it are called
+// through CallContext instead of Call.
+type ContextAction interface {
+	CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error
+}
+
+// ContextActionFunc adapts a function to both Action and ContextAction.
+type ContextActionFunc func(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error
+
+func (f ContextActionFunc) Call(queue string, message *Msg, next func() error) error {
+	return f(context.Background(), queue, message, func(context.Context) error {
+		return next()
+	})
+}
+
+func (f ContextActionFunc) CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+	return f(ctx, queue, message, next)
+}
+
+// JobInfo describes the job being processed.
+type JobInfo struct {
+	Queue string
+	Jid   string
+	// Attempt is 1 the first time a job runs and goes up by one on every retry.
+	Attempt int
+}
+
+type jobInfoKey struct{}
+
+// JobFromContext returns the metadata of the job a context was created for.
+func JobFromContext(ctx context.Context) (*JobInfo, bool) {
+	info, ok := ctx.Value(jobInfoKey{}).(*JobInfo)
+	return info, ok
+}
+
+func newJobContext(ctx context.Context, queue string, message *Msg) context.Context {
+	attempt := 1
+	if count, err := message.Get("retry_count").Int(); err == nil {
+		attempt = count + 2
+	}
+
+	return context.WithValue(ctx, jobInfoKey{}, &JobInfo{
+		Queue:   queue,
+		Jid:     message.Jid(),
+		Attempt: attempt,
+	})
+}
+
+// jobWithContext adapts a handler that doesn't take a context.
+func jobWithContext(job jobFunc) ContextJobFunc {
+	return func(ctx context.Context, message *Msg) error {
+		return job(message)
+	}
+}
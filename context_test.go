@@ -0,0 +1,104 @@
+package workers
+
+import (
+	"context"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+)
+
+type ctxKey string
+
+func ContextSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+
+	c.Specify("JobFromContext", func() {
+		c.Specify("describes a first attempt", func() {
+			message, _ := NewMsg("{\"jid\":\"2309823\"}")
+			ctx := newJobContext(context.Background(), "myqueue", message)
+
+			info, ok := JobFromContext(ctx)
+			c.Expect(ok, IsTrue)
+			c.Expect(info.Queue, Equals, "myqueue")
+			c.Expect(info.Jid, Equals, "2309823")
+			c.Expect(info.Attempt, Equals, 1)
+		})
+
+		c.Specify("counts retries as attempts", func() {
+			message, _ := NewMsg("{\"jid\":\"2309823\",\"retry_count\":0}")
+			info, _ := JobFromContext(newJobContext(context.Background(), "myqueue", message))
+			c.Expect(info.Attempt, Equals, 2)
+		})
+
+		c.Specify("is missing outside of a job", func() {
+			_, ok := JobFromContext(context.Background())
+			c.Expect(ok, IsFalse)
+		})
+	})
+
+	c.Specify("middleware", func() {
+		message, _ := NewMsg("{\"jid\":\"2309823\"}")
+
+		c.Specify("context middleware can pass values to the handler", func() {
+			middleware := NewMiddleware(
+				&m1{},
+				ContextActionFunc(func(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+					return next(context.WithValue(ctx, ctxKey("user"), "bob"))
+				}),
+				&m2{},
+			)
+
+			var user interface{}
+			middleware.callContext(context.Background(), "myqueue", message, func(ctx context.Context) error {
+				user = ctx.Value(ctxKey("user"))
+				return nil
+			})
+
+			c.Expect(user, Equals, "bob")
+		})
+
+		c.Specify("context middleware can be called without a context", func() {
+			called := false
+			action := ContextActionFunc(func(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+				called = true
+				return next(ctx)
+			})
+
+			action.Call("myqueue", message, func() error { return nil })
+			c.Expect(called, IsTrue)
+		})
+	})
+
+	c.Specify("handler context", func() {
+		started := make(chan context.Context)
+		finished := make(chan bool)
+
+		job := func(ctx context.Context, message *Msg) error {
+			started <- ctx
+			<-ctx.Done()
+			finished <- true
+			return nil
+		}
+
+		c.Specify("is cancelled when the manager quits", func() {
+			manager := newManager(config, "contextqueue", nil, 1)
+			manager.contextJob = job
+
+			conn := config.Pool.Get()
+			defer conn.Close()
+			conn.Do("lpush", "prod:queue:contextqueue", "{\"jid\":\"2309823\",\"args\":[]}")
+
+			manager.start()
+			ctx := <-started
+
+			info, _ := JobFromContext(ctx)
+			c.Expect(info.Jid, Equals, "2309823")
+			c.Expect(info.Queue, Equals, "prod:contextqueue")
+
+			go manager.quit()
+			<-finished
+
+			c.Expect(ctx.Err(), Equals, context.Canceled)
+		})
+	})
+}
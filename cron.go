@@ -0,0 +1,294 @@
+package workers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression. Each field is a bitset of the
+// values it matches.
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	location                              *time.Location
+	// wildcard is set when the minute or hour field starts with *, as cron
+	// only adjusts fixed-time schedules to clock changes.
+	wildcard bool
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronSeconds = cronField{0, 59, nil}
+	cronMinutes = cronField{0, 59, nil}
+	cronHours   = cronField{0, 23, nil}
+	cronDom     = cronField{1, 31, nil}
+	cronMonths  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a 5 field (minute hour day-of-month month day-of-week) or
+// 6 field (with seconds first) cron expression, or a descriptor such as
+// @daily. A CRON_TZ=<zone> or TZ=<zone> prefix overrides location.
+func parseCron(spec string, location *time.Location) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.Index(spec, " ")
+		if i < 0 {
+			return nil, fmt.Errorf("cron: missing fields in %q", spec)
+		}
+
+		zone := spec[strings.Index(spec, "=")+1 : i]
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("cron: unknown time zone %q: %v", zone, err)
+		}
+
+		location = loc
+		spec = strings.TrimSpace(spec[i:])
+	}
+
+	if location == nil {
+		location = time.UTC
+	}
+
+	if expanded, ok := cronDescriptors[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("cron: expected 5 or 6 fields, found %d in %q", len(fields), spec)
+	}
+
+	schedule := &cronSchedule{
+		location: location,
+		wildcard: strings.HasPrefix(fields[1], "*") || strings.HasPrefix(fields[2], "*"),
+	}
+
+	for i, target := range []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&schedule.second, cronSeconds},
+		{&schedule.minute, cronMinutes},
+		{&schedule.hour, cronHours},
+		{&schedule.dom, cronDom},
+		{&schedule.month, cronMonths},
+		{&schedule.dow, cronDow},
+	} {
+		bits, err := parseCronField(fields[i], target.field)
+		if err != nil {
+			return nil, fmt.Errorf("cron: %v in %q", err, spec)
+		}
+		*target.bits = bits
+	}
+
+	// Sunday is both 0 and 7.
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+
+	return schedule, nil
+}
+
+// parseCronField parses a comma separated list of *, values, ranges and
+// steps, e.g. "1-5,*/15".
+func parseCronField(expr string, field cronField) (bits uint64, err error) {
+	for _, part := range strings.Split(expr, ",") {
+		step, stepped := 1, false
+		if i := strings.Index(part, "/"); i >= 0 {
+			stepped = true
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			part = part[:i]
+		}
+
+		low, high := field.min, field.max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			if low, err = field.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if high, err = field.value(bounds[1]); err != nil {
+				return 0, err
+			}
+		default:
+			if low, err = field.value(part); err != nil {
+				return 0, err
+			}
+			// "5/10" means from 5 to the end, every 10.
+			if !stepped {
+				high = low
+			}
+		}
+
+		if low > high {
+			return 0, fmt.Errorf("invalid range %q", part)
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+
+	return v, nil
+}
+
+// next returns the first time after t matching the schedule, or the zero
+// time if there's none within five years.
+//
+// Clock changes are handled like Vixie cron: a fixed-time schedule runs once
+// when clocks fall back, and a time skipped when they spring forward runs
+// right after the change. Wildcard schedules follow the clock, so they run
+// in both passes of a repeated hour and not at all in a skipped one.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(s.location).Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		prev := t
+
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = nextHourOr(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location))
+		case !s.dayMatches(t):
+			t = nextHourOr(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location))
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = nextHour(t)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute - time.Duration(t.Second())*time.Second)
+		case s.second&(1<<uint(t.Second())) == 0:
+			t = t.Add(time.Second)
+		case !s.wildcard && repeated(t):
+			t = nextHour(t)
+		default:
+			return t
+		}
+
+		if !s.wildcard && s.skippedMatch(prev, t) {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// matches reports whether the wall clock time t matches the schedule.
+func (s *cronSchedule) matches(t time.Time) bool {
+	return s.month&(1<<uint(t.Month())) != 0 &&
+		s.dayMatches(t) &&
+		s.hour&(1<<uint(t.Hour())) != 0 &&
+		s.minute&(1<<uint(t.Minute())) != 0 &&
+		s.second&(1<<uint(t.Second())) != 0
+}
+
+// skippedMatch reports whether clocks sprang forward between prev and t over
+// a wall clock time matching the schedule.
+func (s *cronSchedule) skippedMatch(prev, t time.Time) bool {
+	from := wallClock(prev).Add(t.Sub(prev))
+	to := wallClock(t)
+
+	for at := from; at.Before(to); at = at.Add(time.Second) {
+		if s.matches(at) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wallClock returns the wall clock time of t, in UTC so it can be stepped
+// through without clock changes.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// repeated reports whether the wall clock time of t already passed once
+// because clocks fell back since.
+func repeated(t time.Time) bool {
+	_, offset := t.Zone()
+	_, before := t.Add(-24 * time.Hour).Zone()
+	if before <= offset {
+		return false
+	}
+
+	_, earlier := t.Add(-time.Duration(before-offset) * time.Second).Zone()
+	return earlier == before
+}
+
+// nextHour returns the start of the hour after t. It steps in absolute time,
+// as time.Date goes back to the first of a repeated hour when clocks fall
+// back.
+func nextHour(t time.Time) time.Time {
+	return t.Add(time.Hour - time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+}
+
+// nextHourOr returns next, unless a clock change made it no later than t.
+func nextHourOr(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return nextHour(t)
+}
+
+// dayMatches follows cron: when both day of month and day of week are
+// restricted, either may match.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.dom == cronAll(cronDom) || s.dow&cronAll(cronDow) == cronAll(cronDow) {
+		return domMatch && dowMatch
+	}
+
+	return domMatch || dowMatch
+}
+
+func cronAll(field cronField) (bits uint64) {
+	for v := field.min; v <= field.max; v++ {
+		bits |= 1 << uint(v)
+	}
+	return
+}
@@ -0,0 +1,182 @@
+package workers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	defaultDeadSet     = "dead"
+	defaultDeadMaxJobs = 10000
+	defaultDeadTimeout = 180 * 24 * 60 * 60
+)
+
+// Moves a dead job back onto its queue, where it runs next, unless it was
+// already removed from the dead set. Returns 1 when it was moved.
+//
+// KEYS[1]: the dead set
+// KEYS[2]: the queue
+// KEYS[3]: the set of queues
+// ARGV[1]: the job in the dead set
+// ARGV[2]: the job to enqueue
+// ARGV[3]: the name of the queue
+var retryDeadScript = redis.NewScript(3, `
+if redis.call('zrem', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('sadd', KEYS[3], ARGV[3])
+redis.call('rpush', KEYS[2], ARGV[2])
+return 1
+`)
+
+// ErrJobNotFound is returned when no job with the given JID exists.
+var ErrJobNotFound = errors.New("job not found")
+
+type DeadJob struct {
+	Msg    *Msg
+	DiedAt float64
+}
+
+// addToDeadSet moves a job that has used up its retries into the dead set,
+// trimming the set to DeadMaxJobs entries no older than DeadTimeout.
+func addToDeadSet(config *config, queue string, message *Msg, jobErr error) error {
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	message.Set("queue", queue)
+	setErrorFields(message, jobErr)
+
+	now := nowToSecondsWithNanoPrecision()
+	key := config.NamespacedKey(config.deadSet)
+
+	conn.Send("multi")
+	conn.Send("zadd", key, now, message.ToJson())
+	conn.Send("zremrangebyscore", key, "-inf", now-float64(config.DeadTimeout))
+	conn.Send("zremrangebyrank", key, 0, -(config.DeadMaxJobs + 1))
+	if _, err := conn.Do("exec"); err != nil {
+		return err
+	}
+
+	if mode, _ := message.Get("unique").String(); UniqueMode(mode) == UniqueUntilExecuted {
+		releaseUnique(config, message)
+	}
+
+	return nil
+}
+
+// DeadJobs returns dead jobs from newest to oldest, start and stop being
+// zero-based, inclusive indexes as understood by zrevrange.
+func (w *Workers) DeadJobs(start, stop int) ([]*DeadJob, error) {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("zrevrange", w.config.NamespacedKey(w.config.deadSet), start, stop, "withscores"))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*DeadJob, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		message, err := NewMsg(values[i])
+		if err != nil {
+			return nil, err
+		}
+
+		var diedAt float64
+		fmt.Sscan(values[i+1], &diedAt)
+
+		jobs = append(jobs, &DeadJob{message, diedAt})
+	}
+
+	return jobs, nil
+}
+
+// RetryDeadJob removes a dead job and puts it back on its queue for one more
+// attempt.
+func (w *Workers) RetryDeadJob(jid string) error {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	key := w.config.NamespacedKey(w.config.deadSet)
+
+	member, err := findInSortedSet(conn, key, jid)
+	if err != nil {
+		return err
+	}
+
+	message, err := NewMsg(member)
+	if err != nil {
+		return err
+	}
+
+	if count, err := message.Get("retry_count").Int(); err == nil && count > 0 {
+		message.Set("retry_count", count-1)
+	}
+
+	queue, _ := message.Get("queue").String()
+	queue = w.config.TrimKeyNamespace(queue)
+	message.Set("enqueued_at", nowToSecondsWithNanoPrecision())
+
+	moved, err := redis.Bool(retryDeadScript.Do(conn,
+		key,
+		w.config.NamespacedKey("queue", queue),
+		w.config.NamespacedKey("queues"),
+		member,
+		message.ToJson(),
+		queue,
+	))
+	if err != nil {
+		return err
+	} else if !moved {
+		return ErrJobNotFound
+	}
+
+	return nil
+}
+
+// DeleteDeadJob removes a dead job for good.
+func (w *Workers) DeleteDeadJob(jid string) error {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	key := w.config.NamespacedKey(w.config.deadSet)
+
+	member, err := findInSortedSet(conn, key, jid)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("zrem", key, member)
+	return err
+}
+
+// findInSortedSet returns the member of a sorted set of messages that has the
+// given JID, or ErrJobNotFound.
+func findInSortedSet(conn redis.Conn, key, jid string) (string, error) {
+	cursor := 0
+	pattern := fmt.Sprintf("*\"jid\":\"%s\"*", jid)
+
+	for {
+		values, err := redis.Values(conn.Do("zscan", key, cursor, "match", pattern))
+		if err != nil {
+			return "", err
+		}
+
+		var members []string
+		if _, err := redis.Scan(values, &cursor, &members); err != nil {
+			return "", err
+		}
+
+		for i := 0; i < len(members); i += 2 {
+			if message, err := NewMsg(members[i]); err == nil && message.Jid() == jid {
+				return members[i], nil
+			}
+		}
+
+		if cursor == 0 {
+			return "", ErrJobNotFound
+		}
+	}
+}
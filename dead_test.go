@@ -0,0 +1,106 @@
+package workers
+
+import (
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func DeadSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	w := mkWorkers(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	message, _ := NewMsg("{\"jid\":\"1\",\"queue\":\"prod:deadqueue\",\"retry\":true,\"retry_count\":25,\"args\":[]}")
+	message2, _ := NewMsg("{\"jid\":\"2\",\"queue\":\"prod:deadqueue\",\"retry\":true,\"retry_count\":25,\"args\":[]}")
+
+	c.Specify("addToDeadSet", func() {
+		c.Specify("trims the dead set to the maximum size", func() {
+			config.DeadMaxJobs = 1
+			defer (func() { config.DeadMaxJobs = defaultDeadMaxJobs })()
+
+			addToDeadSet(config, "prod:deadqueue", message, nil)
+			addToDeadSet(config, "prod:deadqueue", message2, nil)
+
+			jobs, _ := redis.Strings(conn.Do("zrange", "prod:dead", 0, -1))
+			c.Expect(len(jobs), Equals, 1)
+			c.Expect(jobs[0], Equals, message2.ToJson())
+		})
+
+		c.Specify("removes jobs older than the timeout", func() {
+			conn.Do("zadd", "prod:dead", nowToSecondsWithNanoPrecision()-float64(defaultDeadTimeout)-60, message.ToJson())
+
+			addToDeadSet(config, "prod:deadqueue", message2, nil)
+
+			jobs, _ := redis.Strings(conn.Do("zrange", "prod:dead", 0, -1))
+			c.Expect(len(jobs), Equals, 1)
+			c.Expect(jobs[0], Equals, message2.ToJson())
+		})
+	})
+
+	c.Specify("DeadJobs", func() {
+		c.Specify("lists dead jobs newest first", func() {
+			conn.Do("zadd", "prod:dead", 1, message.ToJson())
+			conn.Do("zadd", "prod:dead", 2, message2.ToJson())
+
+			jobs, err := w.DeadJobs(0, -1)
+			c.Expect(err, IsNil)
+			c.Expect(len(jobs), Equals, 2)
+			c.Expect(jobs[0].Msg.Jid(), Equals, "2")
+			c.Expect(jobs[0].DiedAt, Equals, 2.0)
+			c.Expect(jobs[1].Msg.Jid(), Equals, "1")
+		})
+	})
+
+	c.Specify("RetryDeadJob", func() {
+		c.Specify("moves the job back onto its queue", func() {
+			conn.Do("zadd", "prod:dead", 1, message.ToJson())
+			conn.Do("zadd", "prod:dead", 2, message2.ToJson())
+
+			c.Expect(w.RetryDeadJob("1"), IsNil)
+
+			dead, _ := redis.Int(conn.Do("zcard", "prod:dead"))
+			c.Expect(dead, Equals, 1)
+
+			queued, _ := redis.Strings(conn.Do("lrange", "prod:queue:deadqueue", 0, -1))
+			c.Expect(len(queued), Equals, 1)
+
+			retried, _ := NewMsg(queued[0])
+			count, _ := retried.Get("retry_count").Int()
+			c.Expect(retried.Jid(), Equals, "1")
+			c.Expect(count, Equals, 24)
+		})
+
+		c.Specify("runs the job next", func() {
+			conn.Do("lpush", "prod:queue:deadqueue", "{\"jid\":\"waiting\"}")
+			conn.Do("zadd", "prod:dead", 1, message.ToJson())
+
+			c.Expect(w.RetryDeadJob("1"), IsNil)
+
+			next, _ := redis.String(conn.Do("rpop", "prod:queue:deadqueue"))
+			retried, _ := NewMsg(next)
+			c.Expect(retried.Jid(), Equals, "1")
+		})
+
+		c.Specify("fails for an unknown job", func() {
+			c.Expect(w.RetryDeadJob("3"), Equals, ErrJobNotFound)
+		})
+	})
+
+	c.Specify("DeleteDeadJob", func() {
+		c.Specify("removes the job", func() {
+			conn.Do("zadd", "prod:dead", 1, message.ToJson())
+
+			c.Expect(w.DeleteDeadJob("1"), IsNil)
+
+			dead, _ := redis.Int(conn.Do("zcard", "prod:dead"))
+			c.Expect(dead, Equals, 0)
+		})
+
+		c.Specify("fails for an unknown job", func() {
+			c.Expect(w.DeleteDeadJob("3"), Equals, ErrJobNotFound)
+		})
+	})
+}
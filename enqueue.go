@@ -18,6 +18,8 @@ type EnqueueData struct {
 	Args       interface{} `json:"args"`
 	Jid        string      `json:"jid"`
 	EnqueuedAt float64     `json:"enqueued_at"`
+	// UniqueDigest identifies the lock held by a unique job.
+	UniqueDigest string `json:"unique_digest,omitempty"`
 	EnqueueOptions
 }
 
@@ -25,6 +27,21 @@ type EnqueueOptions struct {
 	RetryCount int     `json:"retry_count,omitempty"`
 	Retry      bool    `json:"retry,omitempty"`
 	At         float64 `json:"at,omitempty"`
+	// Timeout is how many seconds the job may run before it's failed,
+	// overriding the queue's timeout.
+	Timeout float64 `json:"timeout,omitempty"`
+	// Unique stops identical jobs being enqueued while this one holds its
+	// lock, EnqueueWithOptions returning this job's JID instead. The mode
+	// decides when the lock is released.
+	Unique UniqueMode `json:"unique,omitempty"`
+	// UniqueFor is how many seconds the lock is held at most, counted from
+	// when the job is due. An hour by default.
+	UniqueFor float64 `json:"-"`
+	// UniqueKey identifies identical jobs, instead of their queue, class and
+	// args.
+	UniqueKey string `json:"-"`
+	// BatchID adds the job to a batch opened with NewBatch.
+	BatchID string `json:"bid,omitempty"`
 }
 
 func generateJid() string {
@@ -60,45 +77,75 @@ func (w *Workers) EnqueueWithOptions(queue, class string, args interface{}, opts
 		EnqueueOptions: opts,
 	}
 
-	bytes, err := json.Marshal(data)
-	if err != nil {
-		return "", err
+	if opts.Unique != "" {
+		digest, err := uniqueDigest(queue, class, args, opts.UniqueKey)
+		if err != nil {
+			return "", err
+		}
+
+		ttl := opts.UniqueFor
+		if ttl <= 0 {
+			ttl = defaultUniqueFor
+		}
+		if now < opts.At {
+			ttl += opts.At - now
+		}
+
+		holder, err := lockUnique(w.config, digest, data.Jid, ttl)
+		if err != nil {
+			return "", err
+		} else if holder != "" {
+			return holder, nil
+		}
+
+		data.UniqueDigest = digest
 	}
 
-	if now < opts.At {
-		err := w.enqueueAt(data.At, bytes)
-		return data.Jid, err
+	jid, err := enqueue(w.config, data, now)
+	if err != nil && data.UniqueDigest != "" {
+		unlockUnique(w.config, data.UniqueDigest, data.Jid)
 	}
 
-	conn := w.config.Pool.Get()
-	defer conn.Close()
+	return jid, err
+}
 
-	_, err = conn.Do("sadd", w.config.NamespacedKey("queues"), queue)
-	if err != nil {
-		return "", err
-	}
-	queue = w.config.NamespacedKey("queue", queue)
-	_, err = conn.Do("rpush", queue, bytes)
+// enqueue pushes data to its queue, or to the scheduled set if it's not due
+// yet, counting it in its batch if it has one.
+func enqueue(config *config, data EnqueueData, now float64) (string, error) {
+	bytes, err := json.Marshal(data)
 	if err != nil {
 		return "", err
 	}
 
-	return data.Jid, nil
-}
-
-func (w *Workers) enqueueAt(at float64, bytes []byte) error {
-	conn := w.config.Pool.Get()
+	conn := config.Pool.Get()
 	defer conn.Close()
 
-	_, err := conn.Do(
-		"zadd",
-		w.config.NamespacedKey(w.config.scheduledJobsQueue), at, bytes,
-	)
+	if data.BatchID != "" {
+		if err := addToBatch(config, conn, data.BatchID, data.Jid); err != nil {
+			return "", err
+		}
+	}
+
+	if now < data.At {
+		err = scheduleMessage(config, conn, config.scheduledJobsQueue, data.At, bytes)
+	} else if _, err = conn.Do("sadd", config.NamespacedKey("queues"), data.Queue); err == nil {
+		_, err = conn.Do("rpush", config.NamespacedKey("queue", data.Queue), bytes)
+	}
+
 	if err != nil {
-		return err
+		if data.BatchID != "" {
+			removeFromBatch(config, conn, data.BatchID, data.Jid)
+		}
+		return "", err
 	}
 
-	return nil
+	state := JobQueued
+	if now < data.At {
+		state = JobScheduled
+	}
+	recordJobStatus(config, conn, data.Jid, state, "queue", data.Queue, "class", data.Class, "enqueued_at", data.EnqueuedAt)
+
+	return data.Jid, nil
 }
 
 func timeToSecondsWithNanoPrecision(t time.Time) float64 {
@@ -75,6 +75,15 @@ func EnqueueSpec(c gospec.Context) {
 			c.Expect(ea, IsWithin(0.1), nowToSecondsWithNanoPrecision())
 		})
 
+		c.Specify("has timeout when set", func() {
+			w.EnqueueWithOptions("enqueue9", "Compare", []string{"foo", "bar"}, EnqueueOptions{Timeout: 2.5})
+
+			bytes, _ := redis.Bytes(conn.Do("lpop", "prod:queue:enqueue9"))
+			var result map[string]interface{}
+			json.Unmarshal(bytes, &result)
+			c.Expect(result["timeout"], Equals, 2.5)
+		})
+
 		c.Specify("has retry and retry_count when set", func() {
 			w.EnqueueWithOptions("enqueue6", "Compare", []string{"foo", "bar"}, EnqueueOptions{RetryCount: 13, Retry: true})
 
@@ -1,6 +1,8 @@
 package workers
 
 import (
+	"time"
+
 	"github.com/customerio/gospec"
 	. "github.com/customerio/gospec"
 	"github.com/garyburd/redigo/redis"
@@ -110,6 +112,34 @@ func FetchSpec(c gospec.Context) {
 			fetch.Close()
 		})
 
+		c.Specify("does not fetch from a paused queue", func() {
+			conn := config.Pool.Get()
+			defer conn.Close()
+
+			conn.Do("sadd", "paused", "fetchQueue7")
+			conn.Do("lpush", "queue:fetchQueue7", message.ToJson())
+
+			fetch := buildFetch(config, "fetchQueue7")
+
+			fetch.Ready() <- true
+
+			select {
+			case <-fetch.Messages():
+				c.Expect("message fetched", Equals, "no message fetched")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			len, _ := redis.Int(conn.Do("llen", "queue:fetchQueue7"))
+			c.Expect(len, Equals, 1)
+
+			conn.Do("srem", "paused", "fetchQueue7")
+
+			fetch.Ready() <- true
+			c.Expect(<-fetch.Messages(), Equals, message)
+
+			fetch.Close()
+		})
+
 		c.Specify("refires any messages left in progress from prior instance", func() {
 			message2, _ := NewMsg("{\"foo\":\"bar2\"}")
 			message3, _ := NewMsg("{\"foo\":\"bar3\"}")
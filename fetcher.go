@@ -28,6 +28,7 @@ type fetch struct {
 	stop            chan bool
 	exit            chan bool
 	closed          chan bool
+	polled          chan bool
 	inprogressQueue string
 }
 
@@ -41,10 +42,17 @@ func NewFetch(config *config, queue string, messages chan *Msg, ready chan bool)
 		make(chan bool),
 		make(chan bool),
 		make(chan bool),
-		fmt.Sprint(queue, ":", config.processId, ":inprogress"),
+		make(chan bool),
+		inprogressQueueKey(config, queue),
 	}
 }
 
+// inprogressQueueKey returns the list holding messages fetched from queue by
+// this process that haven't been acknowledged yet.
+func inprogressQueueKey(config *config, queue string) string {
+	return fmt.Sprint(queue, ":", config.processId, ":inprogress")
+}
+
 func (f *fetch) Queue() string {
 	return f.queue
 }
@@ -63,20 +71,27 @@ func (f *fetch) Fetch() {
 
 	f.processOldMessages()
 
-	go func(c chan string) {
-		for {
-			// f.Close() has been called
-			if f.Closed() {
-				break
-			}
-			<-f.Ready()
-			f.tryFetchMessage(c)
-		}
-	}(messages)
+	go f.poll(func() { f.tryFetchMessage(messages) })
 
 	f.handleMessages(messages)
 }
 
+// poll calls fetchMessage each time a worker is ready, until the fetcher is
+// closed. Close waits for it to return, so nothing is fetched once Close
+// returns.
+func (f *fetch) poll(fetchMessage func()) {
+	defer close(f.polled)
+
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-f.Ready():
+			fetchMessage()
+		}
+	}
+}
+
 func (f *fetch) handleMessages(messages chan string) {
 	for {
 		select {
@@ -96,6 +111,15 @@ func (f *fetch) tryFetchMessage(messages chan string) {
 	conn := f.config.Pool.Get()
 	defer conn.Close()
 
+	if paused, err := queuePaused(f.config, conn, queueNameFromKey(f.config, f.queue)); err != nil {
+		Logger.Println("ERR: ", err)
+		time.Sleep(1 * time.Second)
+		return
+	} else if paused {
+		time.Sleep(1 * time.Second)
+		return
+	}
+
 	message, err := redis.String(conn.Do("brpoplpush", f.queue, f.inprogressQueue, 1))
 
 	if err != nil {
@@ -105,8 +129,67 @@ func (f *fetch) tryFetchMessage(messages chan string) {
 			time.Sleep(1 * time.Second)
 		}
 	} else {
-		messages <- message
+		// Left in the inprogress list if we're closing.
+		select {
+		case messages <- message:
+		case <-f.closed:
+		}
+	}
+}
+
+// Puts a message that waitForMessage rotated to the head of the queue back
+// at the tail, where it was, unless it was taken in the meantime.
+//
+// KEYS[1]: the queue
+// ARGV[1]: the message
+var unrotateScript = redis.NewScript(1, `
+if redis.call('lindex', KEYS[1], 0) == ARGV[1] then
+	redis.call('lpop', KEYS[1])
+	redis.call('rpush', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// waitForMessage blocks until one of queues has a message, or timeout
+// seconds passed, without taking the message. It's for fetchers that can't
+// block while fetching. Returns whether a message came.
+func waitForMessage(config *config, queues []string, timeout int) bool {
+	arrived := make(chan bool, len(queues))
+
+	for _, queue := range queues {
+		go (func(queue string) {
+			arrived <- peekMessage(config, queue, timeout)
+		})(queue)
+	}
+
+	for range queues {
+		if <-arrived {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peekMessage blocks until queue has a message. brpoplpush moves it to the
+// head of the queue, so it's never out of the queue, then it's put back.
+func peekMessage(config *config, queue string, timeout int) bool {
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	message, err := redis.String(conn.Do("brpoplpush", queue, queue, timeout))
+	if err != nil {
+		if err != redis.ErrNil {
+			Logger.Println("ERR: ", err)
+		}
+		return false
 	}
+
+	if _, err := unrotateScript.Do(conn, queue, message); err != nil {
+		Logger.Println("ERR: ", err)
+	}
+
+	return true
 }
 
 func (f *fetch) sendMessage(message string) {
@@ -141,6 +224,7 @@ func (f *fetch) FinishedWork() chan bool {
 func (f *fetch) Close() {
 	f.stop <- true
 	<-f.exit
+	<-f.polled
 }
 
 func (f *fetch) Closed() bool {
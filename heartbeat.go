@@ -0,0 +1,246 @@
+package workers
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// How often the process state is written, and how long it's kept
+	// without being refreshed, in seconds. Same as Sidekiq.
+	heartbeatInterval = 5
+	heartbeatTTL      = 60
+
+	// Set of the processes with inprogress lists, kept after their
+	// heartbeat expires so the reaper can find them.
+	inprogressProcessesSet = "inprogress:processes"
+)
+
+// Forgets the inprogress lists of a process, unless messages are left in
+// them for the reaper to recover. Returns 1 when the process was forgotten.
+//
+// KEYS[1]: the set of processes with inprogress lists
+// KEYS[2]: the hash of the inprogress lists of the process
+// KEYS[3..]: the inprogress lists
+// ARGV[1]: the identity of the process
+var unregisterInprogressScript = redis.NewScript(-1, `
+for i = 3, #KEYS do
+	if redis.call('llen', KEYS[i]) > 0 then
+		return 0
+	end
+end
+redis.call('srem', KEYS[1], ARGV[1])
+redis.call('del', KEYS[2])
+return 1
+`)
+
+// heartbeat publishes this process in Sidekiq's processes set so it shows on
+// the Busy page of the Sidekiq Web UI. The process identity is unique to each
+// run, unlike the ProcessID.
+type heartbeat struct {
+	config    *config
+	managers  []*manager
+	hostname  string
+	startedAt float64
+	closed    chan bool
+	exit      chan bool
+}
+
+// processInfo is the static part of a process, as Sidekiq stores it.
+type processInfo struct {
+	Hostname    string   `json:"hostname"`
+	StartedAt   float64  `json:"started_at"`
+	Pid         int      `json:"pid"`
+	Tag         string   `json:"tag"`
+	Concurrency int      `json:"concurrency"`
+	Queues      []string `json:"queues"`
+	Labels      []string `json:"labels"`
+	Identity    string   `json:"identity"`
+}
+
+// runningJob is an entry of the <identity>:workers hash.
+type runningJob struct {
+	Queue   string `json:"queue"`
+	Payload string `json:"payload"`
+	RunAt   int64  `json:"run_at"`
+}
+
+func (h *heartbeat) start() {
+	h.beat()
+
+	go (func() {
+		for {
+			select {
+			case <-h.closed:
+				h.clear()
+				close(h.exit)
+				return
+			case <-time.After(heartbeatInterval * time.Second):
+				h.beat()
+			}
+		}
+	})()
+}
+
+func (h *heartbeat) quit() {
+	close(h.closed)
+	<-h.exit
+}
+
+func (h *heartbeat) identity() string {
+	return h.config.identity
+}
+
+func (h *heartbeat) beat() {
+	conn := h.config.Pool.Get()
+	defer conn.Close()
+
+	identity := h.identity()
+	key := h.config.NamespacedKey(identity)
+	workersKey := h.config.NamespacedKey(identity, "workers")
+
+	info, busy, jobs := h.snapshot()
+	inprogress := h.inprogressQueues()
+
+	infoJson, err := json.Marshal(info)
+	if err != nil {
+		Logger.Println("ERR: ", err)
+		return
+	}
+
+	conn.Send("multi")
+	conn.Send("sadd", h.config.NamespacedKey("processes"), identity)
+	conn.Send("hmset", key,
+		"info", infoJson,
+		"busy", busy,
+		"beat", nowToSecondsWithNanoPrecision(),
+		"quiet", "false",
+	)
+	conn.Send("expire", key, heartbeatTTL)
+	conn.Send("del", workersKey)
+	if len(jobs) > 0 {
+		conn.Send("hmset", redis.Args{}.Add(workersKey).AddFlat(jobs)...)
+		conn.Send("expire", workersKey, heartbeatTTL)
+	}
+	if len(inprogress) > 0 {
+		conn.Send("sadd", h.config.NamespacedKey(inprogressProcessesSet), identity)
+		conn.Send("hmset", redis.Args{}.Add(processInprogressKey(h.config, identity)).AddFlat(inprogress)...)
+	}
+
+	if _, err := conn.Do("exec"); err != nil {
+		Logger.Println("ERR: couldn't write heartbeat:", err)
+	}
+}
+
+// snapshot collects the process info, how many workers are busy and the jobs
+// they're running, keyed by worker id.
+func (h *heartbeat) snapshot() (info processInfo, busy int, jobs map[string][]byte) {
+	info = processInfo{
+		Hostname:  h.hostname,
+		StartedAt: h.startedAt,
+		Pid:       os.Getpid(),
+		Queues:    []string{},
+		Labels:    []string{},
+		Identity:  h.identity(),
+	}
+	jobs = make(map[string][]byte)
+
+	for _, m := range h.managers {
+		for _, queue := range m.queueNames() {
+			info.Queues = append(info.Queues, h.config.TrimKeyNamespace(queue))
+		}
+
+		m.workersM.Lock()
+		info.Concurrency += m.concurrency
+		for _, worker := range m.workers {
+			message := worker.current()
+			startedAt := atomic.LoadInt64(&worker.startedAt)
+			if message == nil || startedAt == 0 {
+				continue
+			}
+
+			busy++
+
+			job, err := json.Marshal(runningJob{
+				h.config.TrimKeyNamespace(m.queueNameOf(message)),
+				message.ToJson(),
+				startedAt,
+			})
+			if err != nil {
+				Logger.Println("ERR: ", err)
+				continue
+			}
+			jobs[worker.id] = job
+		}
+		m.workersM.Unlock()
+	}
+
+	return
+}
+
+// inprogressQueues maps the inprogress list of every processed queue to the
+// queue.
+func (h *heartbeat) inprogressQueues() map[string]string {
+	lists := make(map[string]string)
+
+	for _, m := range h.managers {
+		for _, queue := range m.queueKeys() {
+			lists[inprogressQueueKey(h.config, queue)] = queue
+		}
+	}
+
+	return lists
+}
+
+// clear removes the process so it disappears from the Web UI straight away
+// rather than when its heartbeat expires. Its inprogress lists stay
+// registered while they hold messages, so the reaper recovers them.
+func (h *heartbeat) clear() {
+	conn := h.config.Pool.Get()
+	defer conn.Close()
+
+	identity := h.identity()
+
+	conn.Send("multi")
+	conn.Send("srem", h.config.NamespacedKey("processes"), identity)
+	conn.Send("del",
+		h.config.NamespacedKey(identity),
+		h.config.NamespacedKey(identity, "workers"),
+	)
+
+	if _, err := conn.Do("exec"); err != nil {
+		Logger.Println("ERR: ", err)
+	}
+
+	keys := []interface{}{h.config.NamespacedKey(inprogressProcessesSet), processInprogressKey(h.config, identity)}
+	for list := range h.inprogressQueues() {
+		keys = append(keys, list)
+	}
+
+	if _, err := unregisterInprogressScript.Do(conn, append([]interface{}{len(keys)}, append(keys, identity)...)...); err != nil {
+		Logger.Println("ERR: ", err)
+	}
+}
+
+// processInprogressKey is the hash of the inprogress lists of a process and
+// the queues they belong to.
+func processInprogressKey(config *config, identity string) string {
+	return config.NamespacedKey(identity, "inprogress")
+}
+
+func newHeartbeat(config *config, managers []*manager) *heartbeat {
+	hostname, _ := os.Hostname()
+
+	return &heartbeat{
+		config,
+		managers,
+		hostname,
+		nowToSecondsWithNanoPrecision(),
+		make(chan bool),
+		make(chan bool),
+	}
+}
@@ -0,0 +1,139 @@
+package workers
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func HeartbeatSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	job := func(message *Msg) error { return nil }
+
+	c.Specify("identifies each run of the process uniquely", func() {
+		other := mkDefaultConfig()
+
+		c.Expect(config.identity, Not(Equals), other.identity)
+		c.Expect(len(strings.Split(config.identity, ":")), Equals, 3)
+	})
+
+	c.Specify("beat", func() {
+		m := newManager(config, "beatqueue", job, 5)
+		heartbeat := newHeartbeat(config, []*manager{m})
+
+		c.Specify("registers the process", func() {
+			heartbeat.beat()
+
+			processes, _ := redis.Strings(conn.Do("smembers", "prod:processes"))
+			c.Expect(len(processes), Equals, 1)
+			c.Expect(processes[0], Equals, config.identity)
+
+			ttl, _ := redis.Int(conn.Do("ttl", "prod:"+config.identity))
+			c.Expect(ttl, Equals, heartbeatTTL)
+		})
+
+		c.Specify("writes the process info", func() {
+			heartbeat.beat()
+
+			data, _ := redis.Bytes(conn.Do("hget", "prod:"+config.identity, "info"))
+			info := processInfo{}
+			c.Expect(json.Unmarshal(data, &info), IsNil)
+
+			c.Expect(info.Identity, Equals, config.identity)
+			c.Expect(info.Hostname, Equals, heartbeat.hostname)
+			c.Expect(info.Concurrency, Equals, 5)
+			c.Expect(len(info.Queues), Equals, 1)
+			c.Expect(info.Queues[0], Equals, "beatqueue")
+
+			beat, _ := redis.Float64(conn.Do("hget", "prod:"+config.identity, "beat"))
+			c.Expect(beat, IsWithin(1), nowToSecondsWithNanoPrecision())
+		})
+
+		c.Specify("lists the jobs being worked on", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"class\":\"Add\",\"args\":[1,2]}")
+
+			busy := newWorker(m)
+			busy.currentMsg.Store(message)
+			busy.startedAt = 1500000000
+			m.workers = []*worker{busy, newWorker(m)}
+
+			heartbeat.beat()
+
+			count, _ := redis.Int(conn.Do("hget", "prod:"+config.identity, "busy"))
+			c.Expect(count, Equals, 1)
+
+			data, _ := redis.Bytes(conn.Do("hget", "prod:"+config.identity+":workers", busy.id))
+			running := map[string]interface{}{}
+			c.Expect(json.Unmarshal(data, &running), IsNil)
+
+			c.Expect(running["queue"], Equals, "beatqueue")
+			c.Expect(running["run_at"], Equals, float64(1500000000))
+			payload, _ := NewMsg(running["payload"].(string))
+			c.Expect(payload.Jid(), Equals, "2")
+		})
+
+		c.Specify("forgets jobs that finished", func() {
+			message, _ := NewMsg("{\"jid\":\"2\"}")
+
+			busy := newWorker(m)
+			busy.currentMsg.Store(message)
+			busy.startedAt = 1500000000
+			m.workers = []*worker{busy}
+
+			heartbeat.beat()
+
+			busy.currentMsg.Store((*Msg)(nil))
+			busy.startedAt = 0
+
+			heartbeat.beat()
+
+			jobs, _ := redis.Int(conn.Do("hlen", "prod:"+config.identity+":workers"))
+			c.Expect(jobs, Equals, 0)
+		})
+
+		c.Specify("forgets inprogress lists that are empty", func() {
+			heartbeat.beat()
+			heartbeat.clear()
+
+			registered, _ := redis.Bool(conn.Do("sismember", "prod:inprogress:processes", config.identity))
+			c.Expect(registered, IsFalse)
+		})
+
+		c.Specify("keeps inprogress lists that hold messages for the reaper", func() {
+			heartbeat.beat()
+			conn.Do("lpush", "prod:queue:beatqueue:1:inprogress", "{\"jid\":\"2\"}")
+			heartbeat.clear()
+
+			registered, _ := redis.Bool(conn.Do("sismember", "prod:inprogress:processes", config.identity))
+			lists, _ := redis.Bool(conn.Do("exists", "prod:"+config.identity+":inprogress"))
+			exists, _ := redis.Bool(conn.Do("exists", "prod:"+config.identity))
+			c.Expect(registered, IsTrue)
+			c.Expect(lists, IsTrue)
+			c.Expect(exists, IsFalse)
+		})
+	})
+
+	c.Specify("removes the process when workers quit", func() {
+		w := mkWorkers(config)
+		w.Process("beatqueue", job, 1)
+
+		w.Start()
+
+		registered, _ := redis.Bool(conn.Do("sismember", "prod:processes", config.identity))
+		c.Expect(registered, IsTrue)
+
+		w.Quit()
+
+		registered, _ = redis.Bool(conn.Do("sismember", "prod:processes", config.identity))
+		exists, _ := redis.Bool(conn.Do("exists", "prod:"+config.identity))
+		c.Expect(registered, IsFalse)
+		c.Expect(exists, IsFalse)
+	})
+}
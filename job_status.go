@@ -0,0 +1,213 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// JobState is where a job is in its life.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobScheduled JobState = "scheduled"
+	JobRunning   JobState = "running"
+	// JobRetrying is a job that failed and is scheduled to run again.
+	JobRetrying JobState = "retrying"
+	// JobSucceeded includes jobs that were discarded.
+	JobSucceeded JobState = "succeeded"
+	// JobFailed is a job that failed with retries disabled, and was dropped.
+	JobFailed JobState = "failed"
+	// JobDead is a job that was moved to the dead set.
+	JobDead JobState = "dead"
+	// JobCancelled is a job stopped with Cancel.
+	JobCancelled JobState = "cancelled"
+)
+
+// JobStatus is what happened to a job, as recorded when JobStatusTTL is set.
+type JobStatus struct {
+	Jid        string
+	Queue      string
+	Class      string
+	State      JobState
+	RetryCount int
+	// Error is the error of the last failure.
+	Error string
+	// Result is what the job recorded with SetResult, as JSON.
+	Result     json.RawMessage
+	EnqueuedAt time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+	UpdatedAt  time.Time
+}
+
+func jobStatusKey(config *config, jid string) string {
+	return config.NamespacedKey("status", jid)
+}
+
+// recordJobStatus sets the state of jid along with the given fields, if job
+// statuses are tracked.
+func recordJobStatus(config *config, conn redis.Conn, jid string, state JobState, fields ...interface{}) {
+	if config.JobStatusTTL <= 0 || jid == "" {
+		return
+	}
+
+	key := jobStatusKey(config, jid)
+
+	conn.Send("multi")
+	conn.Send("hmset", redis.Args{}.Add(key, "state", state, "updated_at", nowToSecondsWithNanoPrecision()).Add(fields...)...)
+	conn.Send("expire", key, config.JobStatusTTL)
+	if _, err := conn.Do("exec"); err != nil {
+		Logger.Println("ERR: couldn't record status of", jid, ":", err)
+	}
+}
+
+// JobStatus returns what happened to the job jid so far. It's only known
+// when JobStatusTTL is set, for that long after the job last changed.
+func (w *Workers) JobStatus(jid string) (*JobStatus, error) {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	fields, err := redis.StringMap(conn.Do("hgetall", jobStatusKey(w.config, jid)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		return nil, ErrJobNotFound
+	}
+
+	status := &JobStatus{
+		Jid:        jid,
+		Queue:      fields["queue"],
+		Class:      fields["class"],
+		State:      JobState(fields["state"]),
+		Error:      fields["error"],
+		EnqueuedAt: parseTimestamp(fields["enqueued_at"]),
+		StartedAt:  parseTimestamp(fields["started_at"]),
+		FinishedAt: parseTimestamp(fields["finished_at"]),
+		UpdatedAt:  parseTimestamp(fields["updated_at"]),
+	}
+	status.RetryCount, _ = strconv.Atoi(fields["retry_count"])
+
+	if result, ok := fields["result"]; ok {
+		status.Result = json.RawMessage(result)
+	}
+
+	return status, nil
+}
+
+// jobResult holds what the running job recorded with SetResult.
+type jobResult struct {
+	value json.RawMessage
+}
+
+type jobResultKey struct{}
+
+// withJobResult returns ctx with somewhere for the job to record its result,
+// reusing the one an outer middleware made.
+func withJobResult(ctx context.Context) (context.Context, *jobResult) {
+	if result, ok := ctx.Value(jobResultKey{}).(*jobResult); ok {
+		return ctx, result
+	}
+
+	result := &jobResult{}
+	return context.WithValue(ctx, jobResultKey{}, result), result
+}
+
+// json returns the recorded result, or null.
+func (r *jobResult) json() []byte {
+	if r.value == nil {
+		return []byte("null")
+	}
+	return r.value
+}
+
+// SetResult records a small result for the running job. It's kept in the
+// job's status when JobStatusTTL is set, and given to the workflow nodes
+// after it through UpstreamResult. Otherwise it does nothing.
+func SetResult(ctx context.Context, result interface{}) error {
+	holder, ok := ctx.Value(jobResultKey{}).(*jobResult)
+	if !ok {
+		return nil
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	holder.value = encoded
+	return nil
+}
+
+// MiddlewareStatus records when jobs start and how they end, if JobStatusTTL
+// is set.
+type MiddlewareStatus struct {
+	config *config
+}
+
+func (s *MiddlewareStatus) Call(queue string, message *Msg, next func() error) error {
+	return s.CallContext(context.Background(), queue, message, func(context.Context) error {
+		return next()
+	})
+}
+
+func (s *MiddlewareStatus) CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+	if s.config.JobStatusTTL <= 0 {
+		return next(ctx)
+	}
+
+	class, _ := message.Get("class").String()
+	retryCount, _ := message.Get("retry_count").Int()
+
+	conn := s.config.Pool.Get()
+	recordJobStatus(s.config, conn, message.Jid(), JobRunning,
+		"queue", queue,
+		"class", class,
+		"retry_count", retryCount,
+		"started_at", nowToSecondsWithNanoPrecision(),
+	)
+	conn.Close()
+
+	ctx, result := withJobResult(ctx)
+	err := next(ctx)
+
+	state, fields := JobSucceeded, []interface{}{"finished_at", nowToSecondsWithNanoPrecision()}
+
+	if err != nil {
+		policy := s.config.retryPolicyFor(ctx, message)
+		var discard *DiscardError
+
+		switch enabled, _ := retryState(message, policy); {
+		case errors.Is(err, ErrJobCancelled):
+			state = JobCancelled
+		case errors.As(err, &discard):
+		case willRetry(message, policy, err):
+			state, fields = JobRetrying, nil
+		case enabled:
+			state = JobDead
+		default:
+			state = JobFailed
+		}
+
+		fields = append(fields, "error", fmt.Sprintf("%v", err))
+	}
+
+	if result.value != nil {
+		fields = append(fields, "result", result.json())
+	}
+
+	conn = s.config.Pool.Get()
+	defer conn.Close()
+
+	recordJobStatus(s.config, conn, message.Jid(), state, fields...)
+
+	return err
+}
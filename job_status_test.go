@@ -0,0 +1,118 @@
+package workers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func JobStatusSpec(c gospec.Context) {
+	config, _ := mkConfig(ConfigureOpts{
+		RedisURL:     redisURL(),
+		ProcessID:    "1",
+		Namespace:    "prod",
+		JobStatusTTL: 3600,
+	})
+	w := mkWorkers(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	wares := NewMiddleware(&MiddlewareStatus{config})
+
+	enqueued := func(opts EnqueueOptions) *Msg {
+		w.EnqueueWithOptions("statusqueue", "Export", []int{1}, opts)
+		json, _ := redis.String(conn.Do("lpop", "prod:queue:statusqueue"))
+		message, _ := NewMsg(json)
+		return message
+	}
+
+	run := func(message *Msg, job func(context.Context) error) {
+		wares.callContext(context.Background(), "statusqueue", message, job)
+	}
+
+	stateOf := func(jid string) JobState {
+		status, _ := w.JobStatus(jid)
+		return status.State
+	}
+
+	c.Specify("records enqueued jobs as queued", func() {
+		jid, _ := w.Enqueue("statusqueue", "Export", []int{1})
+
+		status, err := w.JobStatus(jid)
+		c.Expect(err, IsNil)
+		c.Expect(status.State, Equals, JobQueued)
+		c.Expect(status.Queue, Equals, "statusqueue")
+		c.Expect(status.Class, Equals, "Export")
+		c.Expect(status.EnqueuedAt.IsZero(), IsFalse)
+
+		ttl, _ := redis.Int(conn.Do("ttl", "prod:status:"+jid))
+		c.Expect(float64(ttl), IsWithin(2), 3600.0)
+	})
+
+	c.Specify("records scheduled jobs as scheduled", func() {
+		jid, _ := w.EnqueueIn("statusqueue", "Export", 60, []int{1})
+		c.Expect(stateOf(jid), Equals, JobScheduled)
+	})
+
+	c.Specify("records running jobs", func() {
+		message := enqueued(EnqueueOptions{})
+
+		run(message, func(context.Context) error {
+			c.Expect(stateOf(message.Jid()), Equals, JobRunning)
+			return nil
+		})
+	})
+
+	c.Specify("records succeeded jobs with their result", func() {
+		message := enqueued(EnqueueOptions{})
+
+		run(message, func(ctx context.Context) error {
+			return SetResult(ctx, map[string]string{"url": "exports/1.csv"})
+		})
+
+		status, _ := w.JobStatus(message.Jid())
+		c.Expect(status.State, Equals, JobSucceeded)
+		c.Expect(string(status.Result), Equals, "{\"url\":\"exports/1.csv\"}")
+		c.Expect(status.StartedAt.IsZero(), IsFalse)
+		c.Expect(status.FinishedAt.IsZero(), IsFalse)
+	})
+
+	c.Specify("records jobs that will be retried as retrying", func() {
+		message := enqueued(EnqueueOptions{Retry: true})
+
+		run(message, func(context.Context) error { return errors.New("timeout") })
+
+		status, _ := w.JobStatus(message.Jid())
+		c.Expect(status.State, Equals, JobRetrying)
+		c.Expect(status.Error, Equals, "timeout")
+		c.Expect(status.FinishedAt.IsZero(), IsTrue)
+	})
+
+	c.Specify("records jobs that won't be retried as failed", func() {
+		message := enqueued(EnqueueOptions{})
+
+		run(message, func(context.Context) error { return errors.New("timeout") })
+
+		c.Expect(stateOf(message.Jid()), Equals, JobFailed)
+	})
+
+	c.Specify("records jobs that used up their retries as dead", func() {
+		message := enqueued(EnqueueOptions{Retry: true, RetryCount: DEFAULT_MAX_RETRY})
+
+		run(message, func(context.Context) error { return errors.New("timeout") })
+
+		c.Expect(stateOf(message.Jid()), Equals, JobDead)
+	})
+
+	c.Specify("doesn't record anything without a TTL", func() {
+		w := mkWorkers(mkDefaultConfig())
+		jid, _ := w.Enqueue("statusqueue", "Export", []int{1})
+
+		_, err := w.JobStatus(jid)
+		c.Expect(err, Equals, ErrJobNotFound)
+	})
+}
@@ -0,0 +1,241 @@
+package workers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Leases the next message unless the queue is paused.
+//
+// KEYS[1]: the queue
+// KEYS[2]: the leases of the queue
+// KEYS[3]: the paused set
+// ARGV[1]: the name of the queue as stored in the paused set
+// ARGV[2]: when a lease taken now expires
+var leaseFetchScript = redis.NewScript(3, `
+if redis.call('sismember', KEYS[3], ARGV[1]) == 1 then
+	return false
+end
+local message = redis.call('rpop', KEYS[1])
+if message then
+	redis.call('zadd', KEYS[2], ARGV[2], message)
+end
+return message
+`)
+
+// Puts up to ARGV[2] messages whose lease expired back at the head of the
+// queue. Returns how many were moved.
+//
+// KEYS[1]: the leases of the queue
+// KEYS[2]: the queue
+// ARGV[1]: the current time
+// ARGV[2]: how many messages to move
+var requeueExpiredLeasesScript = redis.NewScript(2, `
+local expired = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1], 'limit', 0, ARGV[2])
+for i = 1, #expired do
+	redis.call('zrem', KEYS[1], expired[i])
+	redis.call('rpush', KEYS[2], expired[i])
+end
+return #expired
+`)
+
+// Pushes back the expiry of a lease, unless it already expired and the
+// message was requeued.
+//
+// KEYS[1]: the leases of the queue
+// ARGV[1]: the new expiry
+// ARGV[2]: the message
+var extendLeaseScript = redis.NewScript(1, `
+if redis.call('zscore', KEYS[1], ARGV[2]) then
+	redis.call('zadd', KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// Puts a leased message back at the head of the queue, unless its lease
+// already expired and it was requeued.
+//
+// KEYS[1]: the leases of the queue
+// KEYS[2]: the queue
+// ARGV[1]: the message
+var requeueLeaseScript = redis.NewScript(2, `
+if redis.call('zrem', KEYS[1], ARGV[1]) == 1 then
+	redis.call('rpush', KEYS[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// leaseFetch is a Fetcher that doesn't rely on a stable ProcessID. Fetched
+// messages are kept in a sorted set shared by every process, scored by when
+// their lease expires. Workers extend the lease while a job runs, and any
+// reaper of any process puts messages with an expired lease back on the queue,
+// so every message is processed at least once.
+type leaseFetch struct {
+	*fetch
+	leases  string
+	timeout time.Duration
+	held    map[*Msg]chan bool
+	heldM   sync.Mutex
+}
+
+// NewLeaseFetch returns a Fetcher for queue that leases messages for
+// timeout.
+func NewLeaseFetch(config *config, queue string, timeout time.Duration, messages chan *Msg, ready chan bool) Fetcher {
+	return &leaseFetch{
+		NewFetch(config, queue, messages, ready).(*fetch),
+		leaseSetKey(queue),
+		timeout,
+		make(map[*Msg]chan bool),
+		sync.Mutex{},
+	}
+}
+
+// leaseSetKey returns the sorted set of the messages leased from queue.
+func leaseSetKey(queue string) string {
+	return fmt.Sprint(queue, ":leases")
+}
+
+func (f *leaseFetch) Fetch() {
+	messages := make(chan string)
+
+	go f.poll(func() { f.tryFetchMessage(messages) })
+
+	f.handleMessages(messages)
+}
+
+func (f *leaseFetch) tryFetchMessage(messages chan string) {
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+
+	// A worker is ready, so keep trying as long as messages arrive.
+	for !f.Closed() {
+		message, err := redis.String(leaseFetchScript.Do(conn,
+			f.queue,
+			f.leases,
+			f.config.NamespacedKey("paused"),
+			queueNameFromKey(f.config, f.queue),
+			nowToSecondsWithNanoPrecision()+durationToSecondsWithNanoPrecision(f.timeout),
+		))
+
+		if err == redis.ErrNil {
+			// The queue is empty or paused.
+			if paused, err := queuePaused(f.config, conn, queueNameFromKey(f.config, f.queue)); err != nil {
+				Logger.Println("ERR: ", err)
+				time.Sleep(1 * time.Second)
+			} else if paused {
+				time.Sleep(1 * time.Second)
+			} else if waitForMessage(f.config, []string{f.queue}, 1) {
+				continue
+			}
+			return
+		} else if err != nil {
+			Logger.Println("ERR: ", err)
+			time.Sleep(1 * time.Second)
+			return
+		}
+
+		// Left leased if we're closing, it's requeued once the lease expires.
+		select {
+		case messages <- message:
+		case <-f.closed:
+		}
+		return
+	}
+}
+
+func (f *leaseFetch) Acknowledge(message *Msg) {
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+	conn.Do("zrem", f.leases, message.OriginalJson())
+}
+
+func (f *leaseFetch) InprogressQueue() string {
+	return f.leases
+}
+
+// holdLease keeps extending the lease of message until release is called.
+func (f *leaseFetch) holdLease(message *Msg) (release func()) {
+	done := make(chan bool)
+
+	f.heldM.Lock()
+	f.held[message] = done
+	f.heldM.Unlock()
+
+	go (func() {
+		ticker := time.NewTicker(f.timeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				f.extendLease(message)
+			}
+		}
+	})()
+
+	return func() {
+		f.heldM.Lock()
+		defer f.heldM.Unlock()
+
+		// Already let go of if it was requeued.
+		if _, ok := f.held[message]; ok {
+			delete(f.held, message)
+			close(done)
+		}
+	}
+}
+
+// requeueLeases stops extending the leases of the messages being processed
+// and puts them back on the queue.
+func (f *leaseFetch) requeueLeases() {
+	f.heldM.Lock()
+	held := f.held
+	f.held = make(map[*Msg]chan bool)
+	f.heldM.Unlock()
+
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+
+	count := 0
+	for message, done := range held {
+		close(done)
+
+		requeued, err := redis.Int(requeueLeaseScript.Do(conn, f.leases, f.queue, message.OriginalJson()))
+		if err != nil {
+			Logger.Println("ERR: couldn't requeue leased message", message.Jid(), ":", err)
+		}
+		count += requeued
+	}
+
+	if count > 0 {
+		Logger.Println("requeued", count, "leased messages for", f.queue)
+	}
+}
+
+func (f *leaseFetch) extendLease(message *Msg) {
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+
+	expiry := nowToSecondsWithNanoPrecision() + durationToSecondsWithNanoPrecision(f.timeout)
+
+	extended, err := redis.Bool(extendLeaseScript.Do(conn, f.leases, expiry, message.OriginalJson()))
+	if err != nil {
+		Logger.Println("ERR: ", err)
+	} else if !extended {
+		Logger.Println("lease of", message.Jid(), "expired before it could be extended, it may run twice.")
+	}
+}
+
+// leaseHolder is implemented by fetchers whose messages must be held while
+// they're processed.
+type leaseHolder interface {
+	holdLease(message *Msg) (release func())
+	requeueLeases()
+}
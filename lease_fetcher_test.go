@@ -0,0 +1,143 @@
+package workers
+
+import (
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func buildLeaseFetch(config *config, queue string, timeout time.Duration) *leaseFetch {
+	fetch := NewLeaseFetch(config, config.NamespacedKey("queue", queue), timeout, make(chan *Msg), make(chan bool)).(*leaseFetch)
+	go fetch.Fetch()
+	return fetch
+}
+
+func LeaseFetchSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	message, _ := NewMsg("{\"jid\":\"1\"}")
+
+	c.Specify("leases fetched messages", func() {
+		conn.Do("lpush", "prod:queue:leasequeue1", message.ToJson())
+
+		fetch := buildLeaseFetch(config, "leasequeue1", time.Minute)
+
+		fetch.Ready() <- true
+		c.Expect(<-fetch.Messages(), Equals, message)
+
+		queued, _ := redis.Int(conn.Do("llen", "prod:queue:leasequeue1"))
+		c.Expect(queued, Equals, 0)
+
+		expiry, _ := redis.Float64(conn.Do("zscore", "prod:queue:leasequeue1:leases", message.ToJson()))
+		c.Expect(expiry, IsWithin(1), nowToSecondsWithNanoPrecision()+60)
+
+		fetch.Close()
+	})
+
+	c.Specify("releases acknowledged messages", func() {
+		conn.Do("lpush", "prod:queue:leasequeue2", message.ToJson())
+
+		fetch := buildLeaseFetch(config, "leasequeue2", time.Minute)
+
+		fetch.Ready() <- true
+		fetch.Acknowledge(<-fetch.Messages())
+
+		leased, _ := redis.Int(conn.Do("zcard", "prod:queue:leasequeue2:leases"))
+		c.Expect(leased, Equals, 0)
+
+		fetch.Close()
+	})
+
+	c.Specify("waits for a message without polling", func() {
+		fetch := buildLeaseFetch(config, "leasequeue3", time.Minute)
+
+		fetch.Ready() <- true
+		time.Sleep(300 * time.Millisecond)
+
+		// Still waiting in the first fetch.
+		select {
+		case fetch.Ready() <- true:
+			c.Expect("second fetch", Equals, "no second fetch")
+		default:
+		}
+
+		conn.Do("lpush", "prod:queue:leasequeue3", message.ToJson())
+
+		start := time.Now()
+		c.Expect(<-fetch.Messages(), Equals, message)
+		c.Expect(time.Since(start) < 500*time.Millisecond, IsTrue)
+
+		fetch.Close()
+	})
+
+	c.Specify("does not fetch from a paused queue", func() {
+		conn.Do("sadd", "prod:paused", "leasequeue4")
+		conn.Do("lpush", "prod:queue:leasequeue4", message.ToJson())
+
+		fetch := buildLeaseFetch(config, "leasequeue4", time.Minute)
+
+		fetch.Ready() <- true
+
+		select {
+		case <-fetch.Messages():
+			c.Expect("message fetched", Equals, "no message fetched")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		conn.Do("srem", "prod:paused", "leasequeue4")
+
+		fetch.Ready() <- true
+		c.Expect(<-fetch.Messages(), Equals, message)
+
+		fetch.Close()
+	})
+
+	c.Specify("extends the lease while the message is held", func() {
+		fetch := NewLeaseFetch(config, "prod:queue:leasequeue5", 300*time.Millisecond, nil, nil).(*leaseFetch)
+
+		leasedAt := nowToSecondsWithNanoPrecision()
+		conn.Do("zadd", "prod:queue:leasequeue5:leases", leasedAt+0.3, message.ToJson())
+
+		release := fetch.holdLease(message)
+		time.Sleep(500 * time.Millisecond)
+		release()
+
+		expiry, _ := redis.Float64(conn.Do("zscore", "prod:queue:leasequeue5:leases", message.ToJson()))
+		c.Expect(expiry > leasedAt+0.5, IsTrue)
+	})
+
+	c.Specify("requeues held leases", func() {
+		fetch := NewLeaseFetch(config, "prod:queue:leasequeue7", time.Minute, nil, nil).(*leaseFetch)
+
+		conn.Do("zadd", "prod:queue:leasequeue7:leases", nowToSecondsWithNanoPrecision()+60, message.ToJson())
+
+		release := fetch.holdLease(message)
+		fetch.requeueLeases()
+		release()
+
+		leased, _ := redis.Int(conn.Do("zcard", "prod:queue:leasequeue7:leases"))
+		c.Expect(leased, Equals, 0)
+
+		queued, _ := redis.Strings(conn.Do("lrange", "prod:queue:leasequeue7", 0, -1))
+		c.Expect(queued, Equals, []string{message.ToJson()})
+	})
+
+	c.Specify("is used by Configure with a visibility timeout", func() {
+		config, err := mkConfig(ConfigureOpts{
+			RedisURL:          redisURL(),
+			VisibilityTimeout: 30,
+		})
+
+		c.Expect(err, IsNil)
+		c.Expect(config.processId, Not(Equals), "")
+
+		fetch, ok := config.Fetch("queue:leasequeue6").(*leaseFetch)
+		c.Expect(ok, IsTrue)
+		c.Expect(fetch.timeout, Equals, 30*time.Second)
+	})
+}
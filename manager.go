@@ -1,32 +1,63 @@
 package workers
 
 import (
+	"context"
 	"strings"
 	"sync"
+	"sync/atomic"
+
+	"github.com/garyburd/redigo/redis"
 )
 
+// Moves every message in an inprogress list back to the head of its queue,
+// oldest message first, and deletes the inprogress list.
+//
+// KEYS[1]: the inprogress list
+// KEYS[2]: the queue
+var requeueInprogressScript = redis.NewScript(2, `
+local messages = redis.call('lrange', KEYS[1], 0, -1)
+for i = 1, #messages do
+	redis.call('rpush', KEYS[2], messages[i])
+end
+redis.call('del', KEYS[1])
+return #messages
+`)
+
 type manager struct {
 	config      *config
 	queue       string
+	queues      []WeightedQueue
+	order       QueueOrder
 	fetch       Fetcher
+	fetchM      *sync.Mutex
 	job         jobFunc
+	contextJob  ContextJobFunc
+	ctx         context.Context
+	cancel      context.CancelFunc
+	options     ProcessOptions
 	concurrency int
 	workers     []*worker
 	workersM    *sync.Mutex
+	running     bool
+	retiring    *sync.WaitGroup
 	confirm     chan *Msg
 	stop        chan bool
 	exit        chan bool
 	mids        *Middlewares
+	abandoned   int32
 	*sync.WaitGroup
 }
 
 func (m *manager) start() {
 	m.Add(1)
+	atomic.StoreInt32(&m.abandoned, 0)
 	m.loadWorkers()
 	go m.manage()
 }
 
 func (m *manager) prepareForQuit() {
+	m.cancel()
+
 	if !m.fetch.Closed() {
 		m.fetch.Close()
 	}
@@ -37,11 +68,15 @@ func (m *manager) quit() {
 	m.prepareForQuit()
 
 	m.workersM.Lock()
+	m.running = false
 	for _, worker := range m.workers {
 		worker.quit()
 	}
+	m.workers = nil
 	m.workersM.Unlock()
 
+	m.retiring.Wait()
+
 	m.stop <- true
 	<-m.exit
 
@@ -50,6 +85,52 @@ func (m *manager) quit() {
 	m.Done()
 }
 
+// abandon puts the messages still being processed back on their queue and
+// stops acknowledging them, as their jobs will run again elsewhere. It must
+// only be called once the fetcher is closed.
+func (m *manager) abandon() {
+	atomic.StoreInt32(&m.abandoned, 1)
+
+	m.fetchM.Lock()
+	fetch := m.fetch
+	m.fetchM.Unlock()
+
+	if holder, ok := fetch.(leaseHolder); ok {
+		holder.requeueLeases()
+	} else {
+		m.requeueInprogress()
+	}
+}
+
+// requeueInprogress puts messages still being processed back on their queue
+// so another process can pick them up.
+func (m *manager) requeueInprogress() {
+	conn := m.config.Pool.Get()
+	defer conn.Close()
+
+	for _, queue := range m.queueKeys() {
+		count, err := redis.Int(requeueInprogressScript.Do(conn, inprogressQueueKey(m.config, queue), queue))
+		if err != nil {
+			Logger.Println("ERR: couldn't requeue in progress messages for", queue, ":", err)
+		} else if count > 0 {
+			Logger.Println("requeued", count, "in progress messages for", queue)
+		}
+	}
+}
+
+// queueKeys returns the namespaced key of every queue the manager processes.
+func (m *manager) queueKeys() []string {
+	if len(m.queues) == 0 {
+		return []string{m.queue}
+	}
+
+	keys := make([]string, len(m.queues))
+	for i, queue := range m.queues {
+		keys[i] = queue.Name
+	}
+	return keys
+}
+
 func (m *manager) manage() {
 	Logger.Println("processing queue", m.queueName(), "with", m.concurrency, "workers.")
 
@@ -58,7 +139,9 @@ func (m *manager) manage() {
 	for {
 		select {
 		case message := <-m.confirm:
-			m.fetch.Acknowledge(message)
+			if atomic.LoadInt32(&m.abandoned) == 0 {
+				m.fetch.Acknowledge(message)
+			}
 		case <-m.stop:
 			m.exit <- true
 			break
@@ -68,13 +151,57 @@ func (m *manager) manage() {
 
 func (m *manager) loadWorkers() {
 	m.workersM.Lock()
-	for i := 0; i < m.concurrency; i++ {
-		m.workers[i] = newWorker(m)
-		m.workers[i].start()
-	}
+	m.running = true
+	m.workers = make([]*worker, 0, m.concurrency)
+	m.addWorkers(m.concurrency)
 	m.workersM.Unlock()
 }
 
+// setConcurrency changes the number of workers for the queue. On a running
+// manager workers are added or retired immediately; retired workers finish
+// their current message before exiting.
+func (m *manager) setConcurrency(concurrency int) {
+	m.workersM.Lock()
+	defer m.workersM.Unlock()
+
+	m.concurrency = concurrency
+
+	if !m.running {
+		return
+	}
+
+	if delta := concurrency - len(m.workers); delta > 0 {
+		m.addWorkers(delta)
+	} else if delta < 0 {
+		m.retireWorkers(-delta)
+	}
+
+	Logger.Println("processing queue", m.queueName(), "with", m.concurrency, "workers.")
+}
+
+// must be called with workersM held
+func (m *manager) addWorkers(count int) {
+	for i := 0; i < count; i++ {
+		worker := newWorker(m)
+		m.workers = append(m.workers, worker)
+		worker.start()
+	}
+}
+
+// must be called with workersM held
+func (m *manager) retireWorkers(count int) {
+	retired := m.workers[len(m.workers)-count:]
+	m.workers = m.workers[:len(m.workers)-count]
+
+	for _, retiree := range retired {
+		m.retiring.Add(1)
+		go (func(w *worker) {
+			w.quit()
+			m.retiring.Done()
+		})(retiree)
+	}
+}
+
 func (m *manager) processing() (count int) {
 	m.workersM.Lock()
 	for _, worker := range m.workers {
@@ -87,29 +214,92 @@ func (m *manager) processing() (count int) {
 }
 
 func (m *manager) queueName() string {
-	return strings.Replace(m.queue, "queue:", "", 1)
+	return strings.Join(m.queueNames(), ",")
+}
+
+// queueNames returns the name of every queue the manager processes.
+func (m *manager) queueNames() []string {
+	if len(m.queues) == 0 {
+		return []string{strings.Replace(m.queue, "queue:", "", 1)}
+	}
+
+	names := make([]string, len(m.queues))
+	for i, queue := range m.queues {
+		names[i] = strings.Replace(queue.Name, "queue:", "", 1)
+	}
+	return names
+}
+
+// queueNameOf returns the name of the queue message was fetched from.
+func (m *manager) queueNameOf(message *Msg) string {
+	if message.source != "" {
+		return strings.Replace(message.source, "queue:", "", 1)
+	}
+
+	return m.queueName()
 }
 
 func (m *manager) reset() {
-	m.fetch = m.config.Fetch(m.queue)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	m.fetchM.Lock()
+	defer m.fetchM.Unlock()
+
+	if len(m.queues) > 0 {
+		m.fetch = m.config.FetchQueues(m.queues, m.order)
+	} else {
+		m.fetch = m.config.Fetch(m.queue)
+	}
 }
 
 func newManager(config *config, queue string, job jobFunc, concurrency int, mids ...Action) *manager {
+	return buildManager(config, config.NamespacedKey("queue", queue), nil, StrictOrder, job, concurrency, mids...)
+}
+
+// newMultiQueueManager returns a manager whose workers are shared between
+// several queues.
+func newMultiQueueManager(config *config, queues []WeightedQueue, order QueueOrder, job jobFunc, concurrency int, mids ...Action) *manager {
+	keys := make([]string, len(queues))
+	namespaced := make([]WeightedQueue, len(queues))
+
+	for i, queue := range queues {
+		keys[i] = config.NamespacedKey("queue", queue.Name)
+		namespaced[i] = WeightedQueue{keys[i], queue.Weight}
+	}
+
+	return buildManager(config, strings.Join(keys, ","), namespaced, order, job, concurrency, mids...)
+}
+
+func buildManager(config *config, queue string, queues []WeightedQueue, order QueueOrder, job jobFunc, concurrency int, mids ...Action) *manager {
 	m := &manager{
 		config,
-		config.NamespacedKey("queue", queue),
+		queue,
+		queues,
+		order,
 		nil,
+		&sync.Mutex{},
 		job,
+		nil,
+		nil,
+		nil,
+		ProcessOptions{},
 		concurrency,
-		make([]*worker, concurrency),
+		nil,
 		&sync.Mutex{},
+		false,
+		&sync.WaitGroup{},
 		make(chan *Msg),
 		make(chan bool),
 		make(chan bool),
 		config.GlobalMiddlewares.AppendToCopy(mids),
+		0,
 		&sync.WaitGroup{},
 	}
 
+	if job != nil {
+		m.contextJob = jobWithContext(job)
+	}
+
 	m.reset()
 
 	return m
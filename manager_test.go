@@ -155,6 +155,75 @@ func ManagerSpec(c gospec.Context) {
 			manager3.quit()
 		})
 
+		c.Specify("setConcurrency adds workers to a running manager", func() {
+			manager := newManager(config, "manager1", testJob, 2)
+			manager.start()
+
+			manager.setConcurrency(5)
+			c.Expect(len(manager.workers), Equals, 5)
+			c.Expect(manager.concurrency, Equals, 5)
+
+			manager.quit()
+		})
+
+		c.Specify("setConcurrency retires workers after their current message", func() {
+			started := make(chan bool)
+			finish := make(chan bool)
+
+			slowJob := (func(message *Msg) error {
+				started <- true
+				<-finish
+				return nil
+			})
+
+			manager := newManager(config, "manager1", slowJob, 2)
+			conn.Do("lpush", "prod:queue:manager1", message.ToJson())
+			conn.Do("lpush", "prod:queue:manager1", message2.ToJson())
+			manager.start()
+			<-started
+			<-started
+
+			retiree := manager.workers[1]
+			manager.setConcurrency(1)
+
+			c.Expect(len(manager.workers), Equals, 1)
+			c.Expect(retiree.processing(), IsTrue)
+
+			close(finish)
+			manager.quit()
+
+			c.Expect(retiree.processing(), IsFalse)
+
+			len, _ := redis.Int(conn.Do("llen", "prod:queue:manager1:1:inprogress"))
+			c.Expect(len, Equals, 0)
+		})
+
+		c.Specify("setConcurrency on a stopped manager only changes the concurrency", func() {
+			manager := newManager(config, "manager1", testJob, 2)
+			manager.setConcurrency(4)
+
+			c.Expect(len(manager.workers), Equals, 0)
+			c.Expect(manager.concurrency, Equals, 4)
+		})
+
+		c.Specify("requeueInprogress moves in progress messages back to the head of the queue", func() {
+			manager := newManager(config, "manager1", testJob, 1)
+
+			conn.Do("lpush", "prod:queue:manager1:1:inprogress", message.ToJson())
+			conn.Do("lpush", "prod:queue:manager1:1:inprogress", message2.ToJson())
+			conn.Do("lpush", "prod:queue:manager1", "{\"foo\":\"queued\"}")
+
+			manager.requeueInprogress()
+
+			messages, _ := redis.Strings(conn.Do("lrange", "prod:queue:manager1", 0, -1))
+			c.Expect(len(messages), Equals, 3)
+			c.Expect(messages[2], Equals, message.ToJson())
+			c.Expect(messages[1], Equals, message2.ToJson())
+
+			inprogress, _ := redis.Int(conn.Do("llen", "prod:queue:manager1:1:inprogress"))
+			c.Expect(inprogress, Equals, 0)
+		})
+
 		c.Specify("prepare stops fetching new messages from queue", func() {
 			manager := newManager(config, "manager2", testJob, 10)
 			manager.start()
@@ -1,5 +1,9 @@
 package workers
 
+import (
+	"context"
+)
+
 type Action interface {
 	Call(queue string, message *Msg, next func() error) error
 }
@@ -38,21 +42,33 @@ func (m *Middlewares) AppendToCopy(mids []Action) *Middlewares {
 }
 
 func (m *Middlewares) call(queue string, message *Msg, final func() error) error {
-	return continuation(m.actions, queue, message, final)()
+	return m.callContext(context.Background(), queue, message, func(context.Context) error {
+		return final()
+	})
+}
+
+func (m *Middlewares) callContext(ctx context.Context, queue string, message *Msg, final func(context.Context) error) error {
+	return continuation(m.actions, queue, message, final)(ctx)
 }
 
-func continuation(actions []Action, queue string, message *Msg, final func() error) func() error {
-	return func() (err error) {
+func continuation(actions []Action, queue string, message *Msg, final func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) (err error) {
 		if len(actions) > 0 {
+			next := continuation(actions[1:], queue, message, final)
+
+			if action, ok := actions[0].(ContextAction); ok {
+				return action.CallContext(ctx, queue, message, next)
+			}
+
 			err = actions[0].Call(
 				queue,
 				message,
-				continuation(actions[1:], queue, message, final),
+				func() error { return next(ctx) },
 			)
 
 			return
 		} else {
-			return final()
+			return markHandlerError(final(ctx))
 		}
 	}
 }
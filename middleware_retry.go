@@ -1,6 +1,8 @@
 package workers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
@@ -16,59 +18,154 @@ type MiddlewareRetry struct {
 	config *config
 }
 
-func (r *MiddlewareRetry) Call(queue string, message *Msg, next func() error) (err error) {
-	err = next()
+func (r *MiddlewareRetry) Call(queue string, message *Msg, next func() error) error {
+	return r.CallContext(context.Background(), queue, message, func(context.Context) error {
+		return next()
+	})
+}
+
+func (r *MiddlewareRetry) CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) (err error) {
+	err = next(ctx)
 
 	if err != nil {
-		if retry(message) {
-			conn := r.config.Pool.Get()
-			defer conn.Close()
+		policy := r.config.retryPolicyFor(ctx, message)
 
-			message.Set("queue", queue)
-			message.Set("error_message", fmt.Sprintf("%v", err))
-			retryCount := incrementRetry(message)
-			err = nil
+		var discard *DiscardError
+		var nonRetryable *NonRetryableError
+		var retryAfter *RetryAfterError
 
-			waitDuration := durationToSecondsWithNanoPrecision(
-				time.Duration(
-					secondsToDelay(retryCount),
-				) * time.Second,
-			)
-
-			_, err = conn.Do(
-				"zadd",
-				r.config.NamespacedKey(r.config.retryQueue),
-				nowToSecondsWithNanoPrecision()+waitDuration,
-				message.ToJson(),
-			)
-
-			// If we can't add the job to the retry queue,
-			// then we shouldn't return the error, otherwise
-			// it'll disappear into the void.
-			if err != nil {
-				Logger.Printf("failed to add job to retry %v", err)
+		if errors.As(err, &discard) {
+			err = nil
+		} else if errors.As(err, &nonRetryable) {
+			if enabled, _ := retryState(message, policy); enabled {
+				err = r.kill(queue, message, err)
+			} else {
 				err = nil
 			}
+		} else if errors.As(err, &retryAfter) && retry(message, policy) {
+			err = r.retry(queue, message, err, func(int) time.Duration { return retryAfter.Delay })
+		} else if retry(message, policy) {
+			err = r.retry(queue, message, err, policy.Delay)
+		} else if retriesExhausted(message, policy) {
+			err = r.kill(queue, message, err)
+		} else if failedInHandler(err) {
+			// Retries are disabled, the job is dropped like Sidekiq does.
+			Logger.Println("ERR: dropping", message.Jid(), "which failed without retries:", err)
+			err = nil
 		}
 	}
 
 	return
 }
 
-func retry(message *Msg) bool {
-	retry := false
-	max := DEFAULT_MAX_RETRY
+// handlerError marks an error returned by the job itself, so middlewares that
+// fail can still refuse acknowledgement when retries are disabled.
+type handlerError struct {
+	error
+}
+
+func (e handlerError) Unwrap() error {
+	return e.error
+}
+
+// markHandlerError tags err as returned by the job.
+func markHandlerError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return handlerError{err}
+}
+
+func failedInHandler(err error) bool {
+	var handlerErr handlerError
+	return errors.As(err, &handlerErr)
+}
+
+// retry schedules message to run again after the delay for its new retry
+// count.
+func (r *MiddlewareRetry) retry(queue string, message *Msg, err error, delay func(retryCount int) time.Duration) error {
+	conn := r.config.Pool.Get()
+	defer conn.Close()
+
+	message.Set("queue", queue)
+	setErrorFields(message, err)
+	retryCount := incrementRetry(message)
+
+	err = scheduleMessage(
+		r.config,
+		conn,
+		r.config.retryQueue,
+		nowToSecondsWithNanoPrecision()+durationToSecondsWithNanoPrecision(delay(retryCount)),
+		[]byte(message.ToJson()),
+	)
+
+	// If we can't add the job to the retry queue,
+	// then we shouldn't return the error, otherwise
+	// it'll disappear into the void.
+	if err != nil {
+		Logger.Printf("failed to add job to retry %v", err)
+	}
+
+	return nil
+}
+
+// kill moves message to the dead set. Once the job is dead it's
+// acknowledged, if we can't move it to the dead set it's left in progress
+// instead.
+func (r *MiddlewareRetry) kill(queue string, message *Msg, err error) error {
+	if deadErr := addToDeadSet(r.config, queue, message, err); deadErr != nil {
+		Logger.Printf("failed to add job to dead set %v", deadErr)
+		return err
+	}
+
+	return nil
+}
+
+// setErrorFields records err on message the way Sidekiq does. Only panics
+// carry a class and backtrace.
+func setErrorFields(message *Msg, err error) {
+	message.Set("error_message", fmt.Sprintf("%v", err))
+
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		message.Set("error_class", "PanicError")
+		message.Set("error_backtrace", panicErr.Backtrace())
+	} else {
+		message.Del("error_class")
+		message.Del("error_backtrace")
+	}
+}
+
+// retryState reports whether retries are enabled for message, and whether it
+// has used them up. A numeric "retry" on the message overrides the policy's
+// maximum.
+func retryState(message *Msg, policy RetryPolicy) (retry bool, exhausted bool) {
+	count, _ := message.Get("retry_count").Int()
 
 	if param, err := message.Get("retry").Bool(); err == nil {
-		retry = param
+		return param, param && policy.GiveUp(count)
 	} else if param, err := message.Get("retry").Int(); err == nil {
-		max = param
-		retry = true
+		return true, count >= param
 	}
 
-	count, _ := message.Get("retry_count").Int()
+	return false, false
+}
+
+func retry(message *Msg, policy RetryPolicy) bool {
+	retry, exhausted := retryState(message, policy)
+	return retry && !exhausted
+}
+
+// willRetry reports whether MiddlewareRetry schedules message to run again
+// after failing with err.
+func willRetry(message *Msg, policy RetryPolicy, err error) bool {
+	return retriable(err) && retry(message, policy)
+}
 
-	return retry && count < max
+// retriesExhausted is true for a retryable message that has no retries left.
+func retriesExhausted(message *Msg, policy RetryPolicy) bool {
+	_, exhausted := retryState(message, policy)
+	return exhausted
 }
 
 func incrementRetry(message *Msg) (retryCount int) {
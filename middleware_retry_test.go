@@ -109,6 +109,33 @@ func MiddlewareRetrySpec(c gospec.Context) {
 		c.Expect(failed_at, Equals, time.Now().UTC().Format(layout))
 	})
 
+	c.Specify("records the class and backtrace of a panic", func() {
+		message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true}")
+
+		panicking := newManager(config, "myqueue", func(message *Msg) error {
+			panic("AHHHH")
+		}, 1)
+
+		err := wares.call("myqueue", message, func() error {
+			return newWorker(panicking).process(message)
+		})
+		c.Expect(err, IsNil)
+
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		retries, _ := redis.Strings(conn.Do("zrange", config.NamespacedKey(config.retryQueue), 0, 1))
+		message, _ = NewMsg(retries[0])
+
+		error_message, _ := message.Get("error_message").String()
+		error_class, _ := message.Get("error_class").String()
+		error_backtrace, _ := message.Get("error_backtrace").StringArray()
+
+		c.Expect(error_message, Equals, "panic: AHHHH")
+		c.Expect(error_class, Equals, "PanicError")
+		c.Expect(len(error_backtrace) > 0, IsTrue)
+	})
+
 	c.Specify("handles recurring failed message", func() {
 		message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true,\"queue\":\"default\",\"error_message\":\"bam\",\"failed_at\":\"2013-07-20 14:03:42 UTC\",\"retry_count\":10}")
 
@@ -175,6 +202,40 @@ func MiddlewareRetrySpec(c gospec.Context) {
 		c.Expect(count, Equals, 0)
 	})
 
+	c.Specify("moves messages to the dead set after their last retry", func() {
+		message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true,\"retry_count\":25}")
+
+		err := wares.call("myqueue", message, func() error {
+			return worker.process(message)
+		})
+		c.Expect(err, IsNil)
+
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		dead, _ := redis.Strings(conn.Do("zrange", config.NamespacedKey("dead"), 0, 1))
+		c.Expect(len(dead), Equals, 1)
+
+		message, _ = NewMsg(dead[0])
+		error_message, _ := message.Get("error_message").String()
+		c.Expect(error_message, Equals, "AHHHH")
+	})
+
+	c.Specify("drops messages without retries instead of moving them to the dead set", func() {
+		message, _ := NewMsg("{\"jid\":\"2\"}")
+
+		err := wares.call("myqueue", message, func() error {
+			return worker.process(message)
+		})
+		c.Expect(err, IsNil)
+
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		count, _ := redis.Int(conn.Do("zcard", config.NamespacedKey("dead")))
+		c.Expect(count, Equals, 0)
+	})
+
 	c.Specify("doesn't retry after customized number of retries", func() {
 		message, _ := NewMsg("{\"jid\":\"2\",\"retry\":3,\"retry_count\":3}")
 
@@ -1,6 +1,7 @@
 package workers
 
 import (
+	"errors"
 	"time"
 )
 
@@ -10,7 +11,9 @@ type MiddlewareStats struct {
 
 func (l *MiddlewareStats) Call(queue string, message *Msg, next func() error) (err error) {
 	err = next()
-	if err != nil {
+
+	var discard *DiscardError
+	if err != nil && !errors.As(err, &discard) {
 		incrementStats(l.config, "failed")
 	}
 
@@ -69,4 +69,23 @@ func MiddlewareStatsSpec(c gospec.Context) {
 			c.Expect(dayCount, Equals, 1)
 		})
 	})
+
+	c.Specify("panicking job", func() {
+		var job = (func(message *Msg) error {
+			panic("AHHHH")
+		})
+
+		manager := newManager(config, "myqueue", job, 1)
+		worker := newWorker(manager)
+
+		c.Specify("increments failed stats", func() {
+			conn := config.Pool.Get()
+			defer conn.Close()
+
+			worker.process(message)
+
+			count, _ := redis.Int(conn.Do("get", "prod:stat:failed"))
+			c.Expect(count, Equals, 1)
+		})
+	})
 }
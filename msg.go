@@ -12,6 +12,8 @@ type data struct {
 type Msg struct {
 	*data
 	original string
+	// namespaced key of the queue the message was fetched from, if known
+	source string
 }
 
 type Args struct {
@@ -54,7 +56,7 @@ func NewMsg(content string) (*Msg, error) {
 	if d, err := newData(content); err != nil {
 		return nil, err
 	} else {
-		return &Msg{d, content}, nil
+		return &Msg{d, content, ""}, nil
 	}
 }
 
@@ -0,0 +1,254 @@
+package workers
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type QueueOrder int
+
+const (
+	// StrictOrder always drains earlier queues before fetching from later ones.
+	StrictOrder QueueOrder = iota
+	// WeightedOrder picks a queue at random on every fetch, in proportion to
+	// its weight, the same way Sidekiq does.
+	WeightedOrder
+)
+
+type WeightedQueue struct {
+	Name   string
+	Weight int
+}
+
+// Moves the first message found into its queue's inprogress list. Paused
+// queues are skipped. Returns the index of the queue and the message.
+//
+// KEYS[1]: the paused set
+// KEYS[2i], KEYS[2i+1]: queue i and its inprogress list
+// ARGV[i]: the name of queue i as stored in the paused set
+var multiFetchScript = redis.NewScript(-1, `
+for i = 1, #ARGV do
+	if redis.call('sismember', KEYS[1], ARGV[i]) == 0 then
+		local message = redis.call('rpoplpush', KEYS[2 * i], KEYS[2 * i + 1])
+		if message then
+			return {i, message}
+		end
+	end
+end
+return false
+`)
+
+type multiFetch struct {
+	*fetch
+	queues           []WeightedQueue
+	order            QueueOrder
+	inprogressQueues []string
+	names            []string
+	fetched          chan *Msg
+}
+
+// NewMultiFetch returns a Fetcher that pulls messages from several queues
+// into one pool of workers. Queue names are namespaced queue keys, as passed
+// to NewFetch.
+func NewMultiFetch(config *config, queues []WeightedQueue, order QueueOrder, messages chan *Msg, ready chan bool) Fetcher {
+	keys := make([]string, len(queues))
+	inprogressQueues := make([]string, len(queues))
+	names := make([]string, len(queues))
+
+	for i, queue := range queues {
+		keys[i] = queue.Name
+		inprogressQueues[i] = inprogressQueueKey(config, queue.Name)
+		names[i] = queueNameFromKey(config, queue.Name)
+	}
+
+	return &multiFetch{
+		NewFetch(config, strings.Join(keys, ","), messages, ready).(*fetch),
+		queues,
+		order,
+		inprogressQueues,
+		names,
+		make(chan *Msg),
+	}
+}
+
+func (f *multiFetch) processOldMessages() {
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+
+	for i, inprogressQueue := range f.inprogressQueues {
+		messages, err := redis.Strings(conn.Do("lrange", inprogressQueue, 0, -1))
+		if err != nil {
+			Logger.Println("ERR: ", err)
+		}
+
+		for _, message := range messages {
+			<-f.Ready()
+			if msg := f.messageFrom(i, message); msg != nil {
+				f.Messages() <- msg
+			}
+		}
+	}
+}
+
+func (f *multiFetch) Fetch() {
+	f.processOldMessages()
+
+	go f.poll(f.tryFetchMessage)
+
+	for {
+		select {
+		case message := <-f.fetched:
+			f.Messages() <- message
+		case <-f.stop:
+			// Stop the redis-polling goroutine
+			close(f.closed)
+			// Signal to Close() that the fetcher has stopped
+			close(f.exit)
+			return
+		}
+	}
+}
+
+func (f *multiFetch) tryFetchMessage() {
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+
+	// A worker is ready, so keep trying as long as messages arrive.
+	for !f.Closed() {
+		order := f.queueOrder()
+		keys := make([]interface{}, 0, 1+2*len(order))
+		keys = append(keys, f.config.NamespacedKey("paused"))
+		names := make([]interface{}, 0, len(order))
+
+		for _, i := range order {
+			keys = append(keys, f.queues[i].Name, f.inprogressQueues[i])
+			names = append(names, f.names[i])
+		}
+
+		reply, err := redis.Values(multiFetchScript.Do(conn, append([]interface{}{len(keys)}, append(keys, names...)...)...))
+
+		if err == redis.ErrNil {
+			// Every queue is empty or paused.
+			if f.waitForMessage(conn) {
+				continue
+			}
+			return
+		} else if err != nil {
+			Logger.Println("ERR: ", err)
+			time.Sleep(1 * time.Second)
+			return
+		}
+
+		var position int
+		var message string
+		if _, err := redis.Scan(reply, &position, &message); err != nil {
+			Logger.Println("ERR: ", err)
+			return
+		}
+
+		if msg := f.messageFrom(order[position-1], message); msg != nil {
+			// Left in the inprogress list if we're closing.
+			select {
+			case f.fetched <- msg:
+			case <-f.closed:
+			}
+		}
+		return
+	}
+}
+
+// waitForMessage blocks until a queue that isn't paused has a message, or a
+// second passed. Returns whether a message came.
+func (f *multiFetch) waitForMessage(conn redis.Conn) bool {
+	paused, err := redis.Strings(conn.Do("smembers", f.config.NamespacedKey("paused")))
+	if err != nil {
+		Logger.Println("ERR: ", err)
+		time.Sleep(1 * time.Second)
+		return false
+	}
+
+	isPaused := make(map[string]bool, len(paused))
+	for _, name := range paused {
+		isPaused[name] = true
+	}
+
+	queues := make([]string, 0, len(f.queues))
+	for i, queue := range f.queues {
+		if !isPaused[f.names[i]] {
+			queues = append(queues, queue.Name)
+		}
+	}
+
+	if len(queues) == 0 {
+		time.Sleep(1 * time.Second)
+		return false
+	}
+
+	return waitForMessage(f.config, queues, 1)
+}
+
+func (f *multiFetch) messageFrom(i int, message string) *Msg {
+	msg, err := NewMsg(message)
+
+	if err != nil {
+		Logger.Println("ERR: Couldn't create message from", message, ":", err)
+		return nil
+	}
+
+	msg.source = f.queues[i].Name
+
+	return msg
+}
+
+// queueOrder returns the indexes of the queues in the order they should be
+// tried for the next fetch.
+func (f *multiFetch) queueOrder() []int {
+	order := make([]int, 0, len(f.queues))
+
+	if f.order == StrictOrder {
+		for i := range f.queues {
+			order = append(order, i)
+		}
+		return order
+	}
+
+	candidates := make([]int, 0, len(f.queues))
+	for i, queue := range f.queues {
+		weight := queue.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		for j := 0; j < weight; j++ {
+			candidates = append(candidates, i)
+		}
+	}
+
+	seen := make(map[int]bool, len(f.queues))
+	for _, j := range rand.Perm(len(candidates)) {
+		if i := candidates[j]; !seen[i] {
+			seen[i] = true
+			order = append(order, i)
+		}
+	}
+
+	return order
+}
+
+func (f *multiFetch) Acknowledge(message *Msg) {
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+
+	for i, queue := range f.queues {
+		if queue.Name == message.source {
+			conn.Do("lrem", f.inprogressQueues[i], -1, message.OriginalJson())
+			return
+		}
+	}
+}
+
+func (f *multiFetch) InprogressQueue() string {
+	return strings.Join(f.inprogressQueues, ",")
+}
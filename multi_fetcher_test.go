@@ -0,0 +1,144 @@
+package workers
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func buildMultiFetch(config *config, order QueueOrder, queues ...WeightedQueue) Fetcher {
+	manager := newMultiQueueManager(config, queues, order, nil, 1)
+	fetch := manager.fetch
+	go fetch.Fetch()
+	return fetch
+}
+
+func MultiFetchSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	config.SetNamespace("")
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	message, _ := NewMsg("{\"foo\":\"bar\"}")
+	message2, _ := NewMsg("{\"foo\":\"bar2\"}")
+
+	c.Specify("strict order fetches from earlier queues first", func() {
+		conn.Do("lpush", "queue:low", message2.ToJson())
+		conn.Do("lpush", "queue:high", message.ToJson())
+
+		fetch := buildMultiFetch(config, StrictOrder, WeightedQueue{"high", 1}, WeightedQueue{"low", 1})
+
+		fetch.Ready() <- true
+		c.Expect(<-fetch.Messages(), Equals, message)
+		fetch.Ready() <- true
+		c.Expect(<-fetch.Messages(), Equals, message2)
+
+		high, _ := redis.Int(conn.Do("llen", "queue:high:1:inprogress"))
+		low, _ := redis.Int(conn.Do("llen", "queue:low:1:inprogress"))
+		c.Expect(high, Equals, 1)
+		c.Expect(low, Equals, 1)
+
+		fetch.Close()
+	})
+
+	c.Specify("waits for a message without polling", func() {
+		fetch := buildMultiFetch(config, StrictOrder, WeightedQueue{"high", 1}, WeightedQueue{"low", 1})
+
+		// Readies taken while the queues are empty, one per fetch.
+		done := make(chan bool)
+		readies := make(chan int)
+		go (func() {
+			count := 0
+			for {
+				select {
+				case fetch.Ready() <- true:
+					count++
+				case <-done:
+					readies <- count
+					return
+				}
+			}
+		})()
+
+		time.Sleep(300 * time.Millisecond)
+		close(done)
+		c.Expect(<-readies, Equals, 1)
+
+		conn.Do("lpush", "queue:low", message.ToJson())
+
+		start := time.Now()
+		c.Expect(<-fetch.Messages(), Equals, message)
+		c.Expect(time.Since(start) < 500*time.Millisecond, IsTrue)
+
+		fetch.Close()
+	})
+
+	c.Specify("skips paused queues", func() {
+		conn.Do("sadd", "paused", "high")
+		conn.Do("lpush", "queue:high", message.ToJson())
+		conn.Do("lpush", "queue:low", message2.ToJson())
+
+		fetch := buildMultiFetch(config, StrictOrder, WeightedQueue{"high", 1}, WeightedQueue{"low", 1})
+
+		fetch.Ready() <- true
+		c.Expect(<-fetch.Messages(), Equals, message2)
+
+		fetch.Close()
+	})
+
+	c.Specify("removes in progress message from its own queue when acknowledged", func() {
+		conn.Do("lpush", "queue:low", message2.ToJson())
+
+		fetch := buildMultiFetch(config, StrictOrder, WeightedQueue{"high", 1}, WeightedQueue{"low", 1})
+
+		fetch.Ready() <- true
+		fetched := <-fetch.Messages()
+		fetch.Acknowledge(fetched)
+
+		low, _ := redis.Int(conn.Do("llen", "queue:low:1:inprogress"))
+		c.Expect(low, Equals, 0)
+
+		fetch.Close()
+	})
+
+	c.Specify("refires messages left in progress on any queue", func() {
+		conn.Do("lpush", "queue:low:1:inprogress", message2.ToJson())
+
+		fetch := buildMultiFetch(config, StrictOrder, WeightedQueue{"high", 1}, WeightedQueue{"low", 1})
+
+		fetch.Ready() <- true
+		fetched := <-fetch.Messages()
+		c.Expect(fetched, Equals, message2)
+		c.Expect(fetched.source, Equals, "queue:low")
+
+		fetch.Close()
+	})
+
+	c.Specify("weighted order tries every queue once", func() {
+		fetch := NewMultiFetch(config, []WeightedQueue{{"queue:a", 3}, {"queue:b", 1}, {"queue:c", 0}}, WeightedOrder, nil, nil).(*multiFetch)
+
+		for i := 0; i < 20; i++ {
+			order := fetch.queueOrder()
+			sort.Ints(order)
+			c.Expect(reflect.DeepEqual(order, []int{0, 1, 2}), IsTrue)
+		}
+	})
+
+	c.Specify("weighted order favours heavier queues", func() {
+		fetch := NewMultiFetch(config, []WeightedQueue{{"queue:a", 9}, {"queue:b", 1}}, WeightedOrder, nil, nil).(*multiFetch)
+
+		first := 0
+		for i := 0; i < 1000; i++ {
+			if fetch.queueOrder()[0] == 0 {
+				first++
+			}
+		}
+
+		c.Expect(first > 800, IsTrue)
+	})
+}
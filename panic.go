@@ -0,0 +1,39 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// PanicError is the error a job fails with when its handler panics.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Backtrace returns the stack of the panic, one frame line per element.
+func (e *PanicError) Backtrace() []string {
+	return strings.Split(strings.TrimSpace(string(e.Stack)), "\n")
+}
+
+func newPanicError(recovered interface{}) *PanicError {
+	Logger.Printf("recovered panic with error '%v'", recovered)
+	return &PanicError{recovered, debug.Stack()}
+}
+
+// callRecovering calls job, turning a panic into a *PanicError.
+func callRecovering(ctx context.Context, message *Msg, job ContextJobFunc) (err error) {
+	defer (func() {
+		if recovered := recover(); recovered != nil {
+			err = newPanicError(recovered)
+		}
+	})()
+
+	return job(ctx, message)
+}
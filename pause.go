@@ -0,0 +1,44 @@
+package workers
+
+import (
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// PauseQueue stops every process from fetching new messages from queue.
+// Messages already in progress are allowed to finish.
+func (w *Workers) PauseQueue(queue string) error {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("sadd", w.config.NamespacedKey("paused"), queue)
+	return err
+}
+
+// ResumeQueue lets every process fetch from a queue paused by PauseQueue.
+func (w *Workers) ResumeQueue(queue string) error {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("srem", w.config.NamespacedKey("paused"), queue)
+	return err
+}
+
+// QueuePaused reports whether queue has been paused by PauseQueue.
+func (w *Workers) QueuePaused(queue string) (bool, error) {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	return queuePaused(w.config, conn, queue)
+}
+
+func queuePaused(config *config, conn redis.Conn, queue string) (bool, error) {
+	return redis.Bool(conn.Do("sismember", config.NamespacedKey("paused"), queue))
+}
+
+// queueNameFromKey turns a namespaced queue key (e.g. "prod:queue:myqueue")
+// back into the queue name used by Enqueue and PauseQueue.
+func queueNameFromKey(config *config, key string) string {
+	return strings.TrimPrefix(config.TrimKeyNamespace(key), "queue:")
+}
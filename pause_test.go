@@ -0,0 +1,51 @@
+package workers
+
+import (
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func PauseSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	w := mkWorkers(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	c.Specify("PauseQueue", func() {
+		c.Specify("marks the queue as paused", func() {
+			c.Expect(w.PauseQueue("myqueue"), IsNil)
+
+			paused, _ := redis.Bool(conn.Do("sismember", "prod:paused", "myqueue"))
+			c.Expect(paused, IsTrue)
+
+			paused, err := w.QueuePaused("myqueue")
+			c.Expect(err, IsNil)
+			c.Expect(paused, IsTrue)
+		})
+	})
+
+	c.Specify("ResumeQueue", func() {
+		c.Specify("clears the paused flag", func() {
+			w.PauseQueue("myqueue")
+			c.Expect(w.ResumeQueue("myqueue"), IsNil)
+
+			paused, _ := w.QueuePaused("myqueue")
+			c.Expect(paused, IsFalse)
+		})
+	})
+
+	c.Specify("QueueStats reports paused queues", func() {
+		w.Enqueue("myqueue", "Add", []int{1, 2})
+		w.Enqueue("otherqueue", "Add", []int{1, 2})
+		w.PauseQueue("myqueue")
+
+		stats, err := w.QueueStats()
+		c.Expect(err, IsNil)
+
+		for _, queue := range stats.Queues {
+			c.Expect(queue.Paused, Equals, queue.Name == "myqueue")
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package workers
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// How long the lock of an enqueued tick is kept, in seconds. It only has to
+// outlast the clock skew between processes.
+const periodicLockTTL = 600
+
+type PeriodicOptions struct {
+	// Location is the time zone the spec is evaluated in, UTC by default. A
+	// spec starting with CRON_TZ=<zone> overrides it.
+	Location *time.Location
+
+	// EnqueueOptions are used for every job enqueued, except At.
+	EnqueueOptions EnqueueOptions
+}
+
+// PeriodicJob describes a schedule registered with Periodic.
+type PeriodicJob struct {
+	ID      string
+	Spec    string
+	Queue   string
+	Class   string
+	Args    interface{}
+	LastRun time.Time
+	NextRun time.Time
+}
+
+type periodicJob struct {
+	id       string
+	spec     string
+	queue    string
+	class    string
+	args     interface{}
+	opts     PeriodicOptions
+	schedule *cronSchedule
+}
+
+// periodic enqueues the jobs of every schedule when they're due. Every
+// process runs the schedules, a lock per schedule and tick makes sure only
+// one of them enqueues each tick.
+type periodic struct {
+	workers *Workers
+	jobs    []*periodicJob
+	closed  chan bool
+	exit    chan bool
+}
+
+// Periodic enqueues class with args on queue on the cron schedule spec, with
+// 5 fields (minute hour day-of-month month day-of-week), 6 fields (seconds
+// first) or a descriptor such as @hourly. Every process should register the
+// same schedules before calling Start; each tick is enqueued once by one of
+// them. Clock changes are handled like Vixie cron: a fixed time (no * in the
+// minute or hour field) runs once when clocks fall back, and right after the
+// change when clocks spring forward over it.
+func (w *Workers) Periodic(spec, queue, class string, args interface{}, opts PeriodicOptions) error {
+	schedule, err := parseCron(spec, opts.Location)
+	if err != nil {
+		return err
+	}
+
+	argsJson, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	id := fmt.Sprintf("%x", sha1.Sum([]byte(spec+"\n"+queue+"\n"+class+"\n"+string(argsJson))))[:16]
+
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	w.periodicJobs = append(w.periodicJobs, &periodicJob{id, spec, queue, class, args, opts, schedule})
+
+	return nil
+}
+
+// PeriodicJobs lists the registered schedules, with when each last enqueued a
+// job in any process, and when it next will.
+func (w *Workers) PeriodicJobs() ([]*PeriodicJob, error) {
+	w.access.Lock()
+	jobs := make([]*periodicJob, len(w.periodicJobs))
+	copy(jobs, w.periodicJobs)
+	w.access.Unlock()
+
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	listed := make([]*PeriodicJob, 0, len(jobs))
+
+	for _, job := range jobs {
+		listed = append(listed, &PeriodicJob{
+			job.id,
+			job.spec,
+			job.queue,
+			job.class,
+			job.args,
+			time.Time{},
+			job.schedule.next(now),
+		})
+	}
+
+	if len(jobs) == 0 {
+		return listed, nil
+	}
+
+	args := redis.Args{}.Add(w.config.NamespacedKey("periodic", "last"))
+	for _, job := range jobs {
+		args = args.Add(job.id)
+	}
+
+	lastRuns, err := redis.Strings(conn.Do("hmget", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, lastRun := range lastRuns {
+		if seconds, err := strconv.ParseInt(lastRun, 10, 64); err == nil {
+			listed[i].LastRun = time.Unix(seconds, 0).In(jobs[i].schedule.location)
+		}
+	}
+
+	return listed, nil
+}
+
+func (p *periodic) start() {
+	go (func() {
+		defer close(p.exit)
+
+		next := make([]time.Time, len(p.jobs))
+		for i, job := range p.jobs {
+			next[i] = job.schedule.next(time.Now())
+		}
+
+		for {
+			wake := time.Time{}
+			for _, tick := range next {
+				if !tick.IsZero() && (wake.IsZero() || tick.Before(wake)) {
+					wake = tick
+				}
+			}
+
+			if wake.IsZero() {
+				<-p.closed
+				return
+			}
+
+			select {
+			case <-p.closed:
+				return
+			case <-time.After(time.Until(wake)):
+			}
+
+			now := time.Now()
+			for i, job := range p.jobs {
+				if !next[i].IsZero() && !next[i].After(now) {
+					p.enqueue(job, next[i])
+					next[i] = job.schedule.next(now)
+				}
+			}
+		}
+	})()
+}
+
+func (p *periodic) quit() {
+	close(p.closed)
+	<-p.exit
+}
+
+// enqueue enqueues the tick of job, unless another process already did.
+func (p *periodic) enqueue(job *periodicJob, tick time.Time) {
+	config := p.workers.config
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	lock := config.NamespacedKey("periodic", job.id, strconv.FormatInt(tick.Unix(), 10))
+
+	locked, err := conn.Do("set", lock, config.processId, "nx", "ex", periodicLockTTL)
+	if err != nil {
+		Logger.Println("ERR: couldn't lock periodic job", job.class, "at", tick, ":", err)
+		return
+	} else if locked == nil {
+		return
+	}
+
+	opts := job.opts.EnqueueOptions
+	opts.At = nowToSecondsWithNanoPrecision()
+
+	if _, err := p.workers.EnqueueWithOptions(job.queue, job.class, job.args, opts); err != nil {
+		Logger.Println("ERR: couldn't enqueue periodic job", job.class, "at", tick, ":", err)
+		return
+	}
+
+	if _, err := conn.Do("hset", config.NamespacedKey("periodic", "last"), job.id, tick.Unix()); err != nil {
+		Logger.Println("ERR: ", err)
+	}
+}
+
+func newPeriodic(workers *Workers, jobs []*periodicJob) *periodic {
+	return &periodic{workers, jobs, make(chan bool), make(chan bool)}
+}
@@ -0,0 +1,169 @@
+package workers
+
+import (
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func PeriodicSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	at := func(value string) time.Time {
+		t, _ := time.Parse(time.RFC3339, value)
+		return t
+	}
+
+	next := func(spec string, from string) string {
+		schedule, err := parseCron(spec, nil)
+		if err != nil {
+			return err.Error()
+		}
+		return schedule.next(at(from)).Format(time.RFC3339)
+	}
+
+	c.Specify("parseCron", func() {
+		c.Specify("parses 5 field specs", func() {
+			c.Expect(next("*/15 * * * *", "2020-01-01T10:07:30Z"), Equals, "2020-01-01T10:15:00Z")
+			c.Expect(next("30 2 * * *", "2020-01-01T10:07:30Z"), Equals, "2020-01-02T02:30:00Z")
+			c.Expect(next("0 9 1,15 * *", "2020-01-02T00:00:00Z"), Equals, "2020-01-15T09:00:00Z")
+			c.Expect(next("0 0 * feb mon-fri", "2020-01-02T00:00:00Z"), Equals, "2020-02-03T00:00:00Z")
+			c.Expect(next("0 0 1 1 *", "2020-01-01T00:00:00Z"), Equals, "2021-01-01T00:00:00Z")
+		})
+
+		c.Specify("parses 6 field specs", func() {
+			c.Expect(next("*/10 * * * * *", "2020-01-01T10:07:31Z"), Equals, "2020-01-01T10:07:40Z")
+			c.Expect(next("5 0 * * * *", "2020-01-01T10:07:31Z"), Equals, "2020-01-01T11:00:05Z")
+		})
+
+		c.Specify("parses descriptors", func() {
+			c.Expect(next("@hourly", "2020-01-01T10:07:31Z"), Equals, "2020-01-01T11:00:00Z")
+			c.Expect(next("@weekly", "2020-01-01T10:07:31Z"), Equals, "2020-01-05T00:00:00Z")
+		})
+
+		c.Specify("treats 7 as sunday", func() {
+			c.Expect(next("0 0 * * 7", "2020-01-01T00:00:00Z"), Equals, "2020-01-05T00:00:00Z")
+		})
+
+		c.Specify("matches either restricted day field", func() {
+			c.Expect(next("0 0 13 * fri", "2020-03-01T00:00:00Z"), Equals, "2020-03-06T00:00:00Z")
+		})
+
+		c.Specify("uses time zones", func() {
+			schedule, err := parseCron("CRON_TZ=America/New_York 0 9 * * *", nil)
+			c.Expect(err, IsNil)
+			c.Expect(schedule.next(at("2020-01-01T00:00:00Z")).UTC().Format(time.RFC3339), Equals, "2020-01-01T14:00:00Z")
+
+			tokyo, _ := time.LoadLocation("Asia/Tokyo")
+			schedule, _ = parseCron("0 9 * * *", tokyo)
+			c.Expect(schedule.next(at("2020-01-01T00:00:00Z")).UTC().Format(time.RFC3339), Equals, "2020-01-02T00:00:00Z")
+		})
+
+		c.Specify("runs fixed times once when clocks fall back", func() {
+			newYork, _ := time.LoadLocation("America/New_York")
+			schedule, _ := parseCron("30 1 * * *", newYork)
+
+			// 01:30 EDT, the first time through the repeated hour.
+			c.Expect(schedule.next(at("2026-11-01T05:00:00Z")).UTC().Format(time.RFC3339), Equals, "2026-11-01T05:30:00Z")
+			// 01:10 EST, the second time through, waits for the next day.
+			c.Expect(schedule.next(at("2026-11-01T06:10:00Z")).UTC().Format(time.RFC3339), Equals, "2026-11-02T06:30:00Z")
+		})
+
+		c.Specify("runs wildcard times in both passes when clocks fall back", func() {
+			newYork, _ := time.LoadLocation("America/New_York")
+			schedule, _ := parseCron("30 * * * *", newYork)
+
+			c.Expect(schedule.next(at("2026-11-01T05:40:00Z")).UTC().Format(time.RFC3339), Equals, "2026-11-01T06:30:00Z")
+		})
+
+		c.Specify("runs skipped fixed times when clocks spring forward", func() {
+			newYork, _ := time.LoadLocation("America/New_York")
+
+			// 02:30 doesn't exist, it runs at 03:00 EDT.
+			schedule, _ := parseCron("30 2 * * *", newYork)
+			c.Expect(schedule.next(at("2026-03-08T06:45:00Z")).UTC().Format(time.RFC3339), Equals, "2026-03-08T07:00:00Z")
+			c.Expect(schedule.next(at("2026-03-08T07:00:00Z")).UTC().Format(time.RFC3339), Equals, "2026-03-09T06:30:00Z")
+		})
+
+		c.Specify("skips wildcard times when clocks spring forward", func() {
+			newYork, _ := time.LoadLocation("America/New_York")
+
+			schedule, _ := parseCron("*/30 2 * * *", newYork)
+			c.Expect(schedule.next(at("2026-03-08T06:45:00Z")).UTC().Format(time.RFC3339), Equals, "2026-03-09T06:00:00Z")
+
+			schedule, _ = parseCron("0 * * * *", newYork)
+			c.Expect(schedule.next(at("2026-03-08T06:30:00Z")).UTC().Format(time.RFC3339), Equals, "2026-03-08T07:00:00Z")
+		})
+
+		c.Specify("rejects invalid specs", func() {
+			for _, spec := range []string{"* * * *", "60 * * * *", "* * * * mon-xyz", "*/0 * * * *", "5-1 * * * *", "TZ=Nowhere/Special * * * * *"} {
+				_, err := parseCron(spec, nil)
+				c.Expect(err, Not(IsNil))
+			}
+		})
+	})
+
+	c.Specify("Periodic", func() {
+		w := mkWorkers(config)
+
+		c.Specify("rejects invalid specs", func() {
+			c.Expect(w.Periodic("not a spec", "cronqueue", "Report", nil, PeriodicOptions{}), Not(IsNil))
+		})
+
+		c.Specify("enqueues every tick once across processes", func() {
+			otherConfig := *config
+			otherConfig.processId = "2"
+			other := mkWorkers(&otherConfig)
+
+			for _, workers := range []*Workers{w, other} {
+				c.Expect(workers.Periodic("* * * * * *", "cronqueue", "Report", []int{1}, PeriodicOptions{}), IsNil)
+			}
+
+			p1 := newPeriodic(w, w.periodicJobs)
+			p2 := newPeriodic(other, other.periodicJobs)
+
+			tick := time.Now().Truncate(time.Second)
+			p1.enqueue(w.periodicJobs[0], tick)
+			p2.enqueue(other.periodicJobs[0], tick)
+			p2.enqueue(other.periodicJobs[0], tick.Add(time.Second))
+
+			queued, _ := redis.Strings(conn.Do("lrange", "prod:queue:cronqueue", 0, -1))
+			c.Expect(len(queued), Equals, 2)
+
+			message, _ := NewMsg(queued[0])
+			class, _ := message.Get("class").String()
+			c.Expect(class, Equals, "Report")
+		})
+
+		c.Specify("enqueues jobs when they're due", func() {
+			w.Periodic("* * * * * *", "cronqueue", "Report", nil, PeriodicOptions{})
+
+			w.Start()
+			time.Sleep(1100 * time.Millisecond)
+			w.Quit()
+
+			queued, _ := redis.Int(conn.Do("llen", "prod:queue:cronqueue"))
+			c.Expect(queued >= 1, IsTrue)
+		})
+
+		c.Specify("lists schedules with their last and next runs", func() {
+			w.Periodic("0 * * * *", "cronqueue", "Report", nil, PeriodicOptions{})
+
+			tick := time.Now().Truncate(time.Hour)
+			newPeriodic(w, w.periodicJobs).enqueue(w.periodicJobs[0], tick)
+
+			jobs, err := w.PeriodicJobs()
+			c.Expect(err, IsNil)
+			c.Expect(len(jobs), Equals, 1)
+			c.Expect(jobs[0].Spec, Equals, "0 * * * *")
+			c.Expect(jobs[0].Class, Equals, "Report")
+			c.Expect(jobs[0].LastRun.Equal(tick), IsTrue)
+			c.Expect(jobs[0].NextRun.Equal(tick.Add(time.Hour)), IsTrue)
+		})
+	})
+}
@@ -0,0 +1,230 @@
+package workers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// How long to wait before polling again when the queue was empty.
+	prefetchIdleSleep = 100 * time.Millisecond
+	// How often acknowledgements are flushed when fewer than a batch are
+	// waiting.
+	ackFlushInterval = 100 * time.Millisecond
+)
+
+// Moves up to ARGV[2] messages into the inprogress list, unless the queue is
+// paused. Returns them oldest first.
+//
+// KEYS[1]: the queue
+// KEYS[2]: the inprogress list
+// KEYS[3]: the paused set
+// ARGV[1]: the name of the queue as stored in the paused set
+// ARGV[2]: how many messages to move
+var prefetchScript = redis.NewScript(3, `
+local messages = {}
+if redis.call('sismember', KEYS[3], ARGV[1]) == 1 then
+	return messages
+end
+for i = 1, tonumber(ARGV[2]) do
+	local message = redis.call('rpoplpush', KEYS[1], KEYS[2])
+	if not message then
+		break
+	end
+	messages[i] = message
+end
+return messages
+`)
+
+// Moves messages that are still in the inprogress list back to the head of
+// the queue, the first message last.
+//
+// KEYS[1]: the inprogress list
+// KEYS[2]: the queue
+var unfetchScript = redis.NewScript(2, `
+for i = #ARGV, 1, -1 do
+	if redis.call('lrem', KEYS[1], -1, ARGV[i]) > 0 then
+		redis.call('rpush', KEYS[2], ARGV[i])
+	end
+end
+return #ARGV
+`)
+
+// prefetch is a Fetcher that moves messages into the inprogress list in
+// batches and buffers them, and acknowledges them in pipelined batches.
+// Messages that were fetched or processed but not yet acknowledged stay in
+// the inprogress list, so they're recovered like with fetch.
+type prefetch struct {
+	*fetch
+	depth     int
+	buffered  []string
+	bufferedM sync.Mutex
+	acks      []string
+	acksM     sync.Mutex
+}
+
+// NewPrefetch returns a Fetcher that moves up to depth messages from queue
+// at a time.
+func NewPrefetch(config *config, queue string, depth int, messages chan *Msg, ready chan bool) Fetcher {
+	return &prefetch{
+		NewFetch(config, queue, messages, ready).(*fetch),
+		depth,
+		nil,
+		sync.Mutex{},
+		nil,
+		sync.Mutex{},
+	}
+}
+
+func (f *prefetch) Fetch() {
+	messages := make(chan string)
+
+	f.processOldMessages()
+
+	go f.poll(func() {
+		if message, ok := f.next(); ok {
+			select {
+			case messages <- message:
+			case <-f.closed:
+				// Buffered again, so Close puts it back on the queue.
+				f.bufferedM.Lock()
+				f.buffered = append([]string{message}, f.buffered...)
+				f.bufferedM.Unlock()
+			}
+		}
+	})
+
+	go f.flushPeriodically()
+
+	f.handleMessages(messages)
+}
+
+// next returns the next buffered message, fetching a batch when the buffer
+// is empty.
+func (f *prefetch) next() (string, bool) {
+	f.bufferedM.Lock()
+	defer f.bufferedM.Unlock()
+
+	if len(f.buffered) == 0 {
+		f.buffered = f.fetchBatch()
+	}
+
+	if len(f.buffered) == 0 {
+		return "", false
+	}
+
+	message := f.buffered[0]
+	f.buffered = f.buffered[1:]
+
+	return message, true
+}
+
+func (f *prefetch) fetchBatch() []string {
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+
+	messages, err := redis.Strings(prefetchScript.Do(conn,
+		f.queue,
+		f.inprogressQueue,
+		f.config.NamespacedKey("paused"),
+		queueNameFromKey(f.config, f.queue),
+		f.depth,
+	))
+
+	if err != nil {
+		Logger.Println("ERR: ", err)
+		time.Sleep(1 * time.Second)
+	} else if len(messages) == 0 {
+		time.Sleep(prefetchIdleSleep)
+	}
+
+	return messages
+}
+
+func (f *prefetch) Acknowledge(message *Msg) {
+	f.acksM.Lock()
+	f.acks = append(f.acks, message.OriginalJson())
+	full := len(f.acks) >= f.depth
+	f.acksM.Unlock()
+
+	// Once closed nothing flushes periodically anymore.
+	if full || f.Closed() {
+		f.flushAcks()
+	}
+}
+
+func (f *prefetch) flushPeriodically() {
+	ticker := time.NewTicker(ackFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-ticker.C:
+			f.flushAcks()
+		}
+	}
+}
+
+// flushAcks removes the acknowledged messages from the inprogress list in
+// one round trip.
+func (f *prefetch) flushAcks() {
+	f.acksM.Lock()
+	acks := f.acks
+	f.acks = nil
+	f.acksM.Unlock()
+
+	if len(acks) == 0 {
+		return
+	}
+
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+
+	for _, message := range acks {
+		conn.Send("lrem", f.inprogressQueue, -1, message)
+	}
+
+	if err := conn.Flush(); err != nil {
+		Logger.Println("ERR: ", err)
+		return
+	}
+
+	for range acks {
+		if _, err := conn.Receive(); err != nil {
+			Logger.Println("ERR: ", err)
+		}
+	}
+}
+
+// Close stops fetching and puts buffered messages no worker took back on the
+// queue.
+func (f *prefetch) Close() {
+	f.fetch.Close()
+	f.flushAcks()
+
+	f.bufferedM.Lock()
+	buffered := f.buffered
+	f.buffered = nil
+	f.bufferedM.Unlock()
+
+	if len(buffered) == 0 {
+		return
+	}
+
+	conn := f.config.Pool.Get()
+	defer conn.Close()
+
+	args := make([]interface{}, 0, 2+len(buffered))
+	args = append(args, f.inprogressQueue, f.queue)
+	for _, message := range buffered {
+		args = append(args, message)
+	}
+
+	if _, err := unfetchScript.Do(conn, args...); err != nil {
+		Logger.Println("ERR: couldn't requeue prefetched messages:", err)
+	}
+}
@@ -0,0 +1,116 @@
+package workers
+
+import (
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func buildPrefetch(config *config, queue string, depth int) Fetcher {
+	fetch := NewPrefetch(config, config.NamespacedKey("queue", queue), depth, make(chan *Msg), make(chan bool))
+	go fetch.Fetch()
+	return fetch
+}
+
+func PrefetchSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	message1, _ := NewMsg("{\"jid\":\"1\"}")
+	message2, _ := NewMsg("{\"jid\":\"2\"}")
+	message3, _ := NewMsg("{\"jid\":\"3\"}")
+
+	enqueue := func(queue string) {
+		for _, message := range []*Msg{message1, message2, message3} {
+			conn.Do("lpush", "prod:queue:"+queue, message.ToJson())
+		}
+	}
+
+	c.Specify("moves a batch of messages into the inprogress list", func() {
+		enqueue("prefetchqueue1")
+		fetch := buildPrefetch(config, "prefetchqueue1", 2)
+
+		fetch.Ready() <- true
+		c.Expect(<-fetch.Messages(), Equals, message1)
+
+		queued, _ := redis.Int(conn.Do("llen", "prod:queue:prefetchqueue1"))
+		inprogress, _ := redis.Int(conn.Do("llen", "prod:queue:prefetchqueue1:1:inprogress"))
+		c.Expect(queued, Equals, 1)
+		c.Expect(inprogress, Equals, 2)
+
+		fetch.Ready() <- true
+		c.Expect(<-fetch.Messages(), Equals, message2)
+		fetch.Ready() <- true
+		c.Expect(<-fetch.Messages(), Equals, message3)
+
+		fetch.Close()
+	})
+
+	c.Specify("flushes acknowledgements once a batch is waiting", func() {
+		enqueue("prefetchqueue2")
+		fetch := buildPrefetch(config, "prefetchqueue2", 2)
+
+		fetch.Ready() <- true
+		fetch.Acknowledge(<-fetch.Messages())
+		fetch.Ready() <- true
+		fetch.Acknowledge(<-fetch.Messages())
+
+		inprogress, _ := redis.Int(conn.Do("llen", "prod:queue:prefetchqueue2:1:inprogress"))
+		c.Expect(inprogress, Equals, 0)
+
+		fetch.Close()
+	})
+
+	c.Specify("flushes acknowledgements periodically", func() {
+		enqueue("prefetchqueue3")
+		fetch := buildPrefetch(config, "prefetchqueue3", 3)
+
+		fetch.Ready() <- true
+		fetch.Acknowledge(<-fetch.Messages())
+
+		time.Sleep(3 * ackFlushInterval)
+
+		inprogress, _ := redis.Strings(conn.Do("lrange", "prod:queue:prefetchqueue3:1:inprogress", 0, -1))
+		c.Expect(len(inprogress), Equals, 2)
+		c.Expect(inprogress, Not(Contains), message1.ToJson())
+
+		fetch.Close()
+	})
+
+	c.Specify("puts buffered messages back on the queue when closed", func() {
+		enqueue("prefetchqueue4")
+		fetch := buildPrefetch(config, "prefetchqueue4", 3)
+
+		fetch.Ready() <- true
+		c.Expect(<-fetch.Messages(), Equals, message1)
+
+		fetch.Close()
+
+		queued, _ := redis.Strings(conn.Do("lrange", "prod:queue:prefetchqueue4", 0, -1))
+		c.Expect(len(queued), Equals, 2)
+		c.Expect(queued[0], Equals, message3.ToJson())
+		c.Expect(queued[1], Equals, message2.ToJson())
+
+		inprogress, _ := redis.Strings(conn.Do("lrange", "prod:queue:prefetchqueue4:1:inprogress", 0, -1))
+		c.Expect(len(inprogress), Equals, 1)
+		c.Expect(inprogress[0], Equals, message1.ToJson())
+	})
+
+	c.Specify("is used by Configure with a prefetch depth", func() {
+		config, err := mkConfig(ConfigureOpts{
+			RedisURL:  redisURL(),
+			ProcessID: "1",
+			Prefetch:  10,
+		})
+
+		c.Expect(err, IsNil)
+
+		fetch, ok := config.Fetch("queue:prefetchqueue5").(*prefetch)
+		c.Expect(ok, IsTrue)
+		c.Expect(fetch.depth, Equals, 10)
+	})
+}
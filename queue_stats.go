@@ -9,12 +9,16 @@ import (
 type QueueStats struct {
 	Queues     []*QueueDepth
 	RetryDepth int
+	DeadDepth  int
+	// RateLimits are the limiters of this process's queues and classes.
+	RateLimits []*RateLimitState
 }
 
 type QueueDepth struct {
 	Name       string
 	InProgress int
 	Queued     int
+	Paused     bool
 }
 
 func (w *Workers) QueueStats() (queueStats *QueueStats, err error) {
@@ -32,11 +36,13 @@ func (w *Workers) QueueStats() (queueStats *QueueStats, err error) {
 	}
 
 	conn.Send("zcard", config.NamespacedKey(w.config.retryQueue))
+	conn.Send("zcard", config.NamespacedKey(w.config.deadSet))
 	i := 0
 	for _, queue := range queues {
 		conn.Send("llen", config.NamespacedKey("queue", queue))
 		inprogressQueue := fmt.Sprint(queue, ":", config.processId, ":inprogress")
 		conn.Send("llen", config.NamespacedKey(inprogressQueue))
+		conn.Send("sismember", config.NamespacedKey("paused"), queue)
 		i++
 	}
 	conn.Flush()
@@ -47,8 +53,15 @@ func (w *Workers) QueueStats() (queueStats *QueueStats, err error) {
 	}
 	queueStats.RetryDepth = retryDepth
 
+	deadDepth, err := redis.Int(conn.Receive())
+	if err != nil {
+		return
+	}
+	queueStats.DeadDepth = deadDepth
+
 	for i, queue := range queues {
 		var queued, inprogress int
+		var paused bool
 		queued, err = redis.Int(conn.Receive())
 		if err != nil {
 			return
@@ -57,13 +70,20 @@ func (w *Workers) QueueStats() (queueStats *QueueStats, err error) {
 		if err != nil {
 			return
 		}
+		paused, err = redis.Bool(conn.Receive())
+		if err != nil {
+			return
+		}
 
 		queueStats.Queues[i] = &QueueDepth{
 			queue,
 			inprogress,
 			queued,
+			paused,
 		}
 	}
 
+	queueStats.RateLimits, err = w.rateLimitStates(conn)
+
 	return
 }
@@ -0,0 +1,345 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RateLimiter limits how often jobs run across every process. Jobs over the
+// limit are rescheduled for when the limit allows them, without counting as
+// a failure or a retry.
+type RateLimiter interface {
+	// take takes one request, returning how long until one is allowed if
+	// the limit is reached.
+	take(config *config, conn redis.Conn, now float64) (wait time.Duration, err error)
+	// state describes the limit as it stands.
+	state(config *config, conn redis.Conn, now float64) (*RateLimitState, error)
+	// withDefaults returns a copy named name unless it has a Name, or an
+	// error if the limit is invalid.
+	withDefaults(name string) (RateLimiter, error)
+}
+
+// RateLimitState is how much of a rate limit is left.
+type RateLimitState struct {
+	Name      string
+	Limit     int
+	Remaining int
+	// ResetIn is how long until a request is allowed again, when none are.
+	ResetIn time.Duration
+}
+
+// TokenBucket allows Burst requests at once, refilled at Rate requests per
+// Interval. Limiters with the same Name share their state; it defaults to the
+// class or queue the limiter is set for.
+type TokenBucket struct {
+	Name     string
+	Rate     int
+	Interval time.Duration
+	// Burst defaults to Rate.
+	Burst int
+}
+
+// SlidingWindow allows Limit requests in any Window. Limiters with the same
+// Name share their state; it defaults to the class or queue the limiter is
+// set for.
+type SlidingWindow struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// Takes a token from a bucket refilled continuously. Returns "0", or how
+// many seconds until a token is available.
+//
+// KEYS[1]: the bucket
+// ARGV[1]: how many tokens the bucket holds
+// ARGV[2]: how many tokens are added per second
+// ARGV[3]: the current time
+var tokenBucketScript = redis.NewScript(1, `
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('hmget', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(bucket[1]) or capacity
+local at = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - at) * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = (1 - tokens) / rate
+end
+redis.call('hmset', KEYS[1], 'tokens', tostring(tokens), 'at', ARGV[3])
+redis.call('expire', KEYS[1], math.ceil(capacity / rate) + 1)
+return tostring(wait)
+`)
+
+// Records a request in a window, unless it's full. Returns "0", or how many
+// seconds until the oldest request leaves the window.
+//
+// KEYS[1]: the window
+// ARGV[1]: how many requests the window allows
+// ARGV[2]: the length of the window in seconds
+// ARGV[3]: the current time
+// ARGV[4]: a unique id for the request
+var slidingWindowScript = redis.NewScript(1, `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+redis.call('zremrangebyscore', KEYS[1], '-inf', now - window)
+if redis.call('zcard', KEYS[1]) < limit then
+	redis.call('zadd', KEYS[1], ARGV[3], ARGV[4])
+	redis.call('expire', KEYS[1], math.ceil(window) + 1)
+	return '0'
+end
+local oldest = redis.call('zrange', KEYS[1], 0, 0, 'withscores')
+return tostring(tonumber(oldest[2]) + window - now)
+`)
+
+func rateLimitKey(config *config, name string) string {
+	return config.NamespacedKey("ratelimit", name)
+}
+
+func (b *TokenBucket) withDefaults(name string) (RateLimiter, error) {
+	if b.Rate <= 0 || b.Interval <= 0 || b.Burst < 0 {
+		return nil, fmt.Errorf("invalid token bucket %d/%v (burst %d) for %s", b.Rate, b.Interval, b.Burst, name)
+	}
+
+	bucket := *b
+	if bucket.Name == "" {
+		bucket.Name = name
+	}
+	return &bucket, nil
+}
+
+func (b *TokenBucket) burst() int {
+	if b.Burst > 0 {
+		return b.Burst
+	}
+	return b.Rate
+}
+
+// refillRate is how many tokens are added per second.
+func (b *TokenBucket) refillRate() float64 {
+	return float64(b.Rate) / b.Interval.Seconds()
+}
+
+func (b *TokenBucket) take(config *config, conn redis.Conn, now float64) (time.Duration, error) {
+	wait, err := redis.String(tokenBucketScript.Do(conn, rateLimitKey(config, b.Name), b.burst(), b.refillRate(), now))
+	if err != nil {
+		return 0, err
+	}
+
+	return parseSeconds(wait)
+}
+
+func (b *TokenBucket) state(config *config, conn redis.Conn, now float64) (*RateLimitState, error) {
+	bucket, err := redis.Strings(conn.Do("hmget", rateLimitKey(config, b.Name), "tokens", "at"))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := float64(b.burst())
+	if len(bucket) == 2 && bucket[0] != "" {
+		last, _ := strconv.ParseFloat(bucket[0], 64)
+		at, _ := strconv.ParseFloat(bucket[1], 64)
+		tokens = math.Min(tokens, last+math.Max(0, now-at)*b.refillRate())
+	}
+
+	state := &RateLimitState{b.Name, b.burst(), int(tokens), 0}
+	if tokens < 1 {
+		state.ResetIn = secondsToDuration((1 - tokens) / b.refillRate())
+	}
+
+	return state, nil
+}
+
+func (s *SlidingWindow) withDefaults(name string) (RateLimiter, error) {
+	if s.Limit <= 0 || s.Window <= 0 {
+		return nil, fmt.Errorf("invalid sliding window %d/%v for %s", s.Limit, s.Window, name)
+	}
+
+	window := *s
+	if window.Name == "" {
+		window.Name = name
+	}
+	return &window, nil
+}
+
+func (s *SlidingWindow) take(config *config, conn redis.Conn, now float64) (time.Duration, error) {
+	wait, err := redis.String(slidingWindowScript.Do(conn, rateLimitKey(config, s.Name), s.Limit, s.Window.Seconds(), now, generateJid()))
+	if err != nil {
+		return 0, err
+	}
+
+	return parseSeconds(wait)
+}
+
+func (s *SlidingWindow) state(config *config, conn redis.Conn, now float64) (*RateLimitState, error) {
+	requests, err := redis.Strings(conn.Do("zrangebyscore", rateLimitKey(config, s.Name), now-s.Window.Seconds(), "+inf", "withscores"))
+	if err != nil {
+		return nil, err
+	}
+
+	count := len(requests) / 2
+	state := &RateLimitState{s.Name, s.Limit, 0, 0}
+
+	if count < s.Limit {
+		state.Remaining = s.Limit - count
+	} else if oldest, err := strconv.ParseFloat(requests[1], 64); err == nil {
+		state.ResetIn = secondsToDuration(oldest + s.Window.Seconds() - now)
+	}
+
+	return state, nil
+}
+
+func parseSeconds(seconds string) (time.Duration, error) {
+	value, err := strconv.ParseFloat(seconds, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return secondsToDuration(value), nil
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// rateLimiters holds the limiters registered per job class.
+type rateLimiters struct {
+	sync.RWMutex
+	byClass map[string]RateLimiter
+}
+
+// SetRateLimiter limits jobs of class with limiter, whatever queue they're
+// on.
+func (w *Workers) SetRateLimiter(class string, limiter RateLimiter) error {
+	limiter, err := limiter.withDefaults(class)
+	if err != nil {
+		return err
+	}
+
+	w.config.rateLimiters.Lock()
+	defer w.config.rateLimiters.Unlock()
+
+	w.config.rateLimiters.byClass[class] = limiter
+	return nil
+}
+
+type queueRateLimiterKey struct{}
+
+// withQueueRateLimiter records the rate limiter of the queue a job was
+// fetched from on its context.
+func withQueueRateLimiter(ctx context.Context, limiter RateLimiter) context.Context {
+	if limiter == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, queueRateLimiterKey{}, limiter)
+}
+
+// rateLimitersFor returns the limiters message must pass: its queue's and its
+// class's.
+func (c *config) rateLimitersFor(ctx context.Context, message *Msg) []RateLimiter {
+	var limiters []RateLimiter
+
+	if limiter, ok := ctx.Value(queueRateLimiterKey{}).(RateLimiter); ok {
+		limiters = append(limiters, limiter)
+	}
+
+	if class, err := message.Get("class").String(); err == nil {
+		c.rateLimiters.RLock()
+		limiter, ok := c.rateLimiters.byClass[class]
+		c.rateLimiters.RUnlock()
+
+		if ok {
+			limiters = append(limiters, limiter)
+		}
+	}
+
+	return limiters
+}
+
+// MiddlewareRateLimit reschedules jobs over their queue's or class's rate
+// limit for when the limit allows them. They're acknowledged without running
+// and without counting as processed, failed or retried.
+type MiddlewareRateLimit struct {
+	config *config
+}
+
+func (l *MiddlewareRateLimit) Call(queue string, message *Msg, next func() error) error {
+	return l.CallContext(context.Background(), queue, message, func(context.Context) error {
+		return next()
+	})
+}
+
+func (l *MiddlewareRateLimit) CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+	limiters := l.config.rateLimitersFor(ctx, message)
+	if len(limiters) == 0 {
+		return next(ctx)
+	}
+
+	conn := l.config.Pool.Get()
+	defer conn.Close()
+
+	now := nowToSecondsWithNanoPrecision()
+
+	for _, limiter := range limiters {
+		wait, err := limiter.take(l.config, conn, now)
+		if err != nil {
+			// Better to exceed the limit than to stop processing.
+			Logger.Println("ERR: couldn't check rate limit:", err)
+			continue
+		}
+
+		if wait > 0 {
+			message.Set("queue", queue)
+			return scheduleMessage(l.config, conn, l.config.scheduledJobsQueue, now+wait.Seconds(), []byte(message.ToJson()))
+		}
+	}
+
+	return next(ctx)
+}
+
+// rateLimitStates returns the state of every limiter registered in this
+// process, by name.
+func (w *Workers) rateLimitStates(conn redis.Conn) ([]*RateLimitState, error) {
+	limiters := make(map[RateLimiter]bool)
+
+	w.config.rateLimiters.RLock()
+	for _, limiter := range w.config.rateLimiters.byClass {
+		limiters[limiter] = true
+	}
+	w.config.rateLimiters.RUnlock()
+
+	w.access.Lock()
+	for _, manager := range w.managers {
+		if manager.options.RateLimiter != nil {
+			limiters[manager.options.RateLimiter] = true
+		}
+	}
+	w.access.Unlock()
+
+	now := nowToSecondsWithNanoPrecision()
+	states := make([]*RateLimitState, 0, len(limiters))
+
+	for limiter := range limiters {
+		state, err := limiter.state(w.config, conn, now)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+
+	return states, nil
+}
@@ -0,0 +1,189 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func RateLimitSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	w := mkWorkers(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	now := nowToSecondsWithNanoPrecision()
+
+	c.Specify("TokenBucket", func() {
+		bucket := &TokenBucket{Name: "api", Rate: 2, Interval: time.Second}
+
+		c.Specify("allows a burst of requests", func() {
+			for i := 0; i < 2; i++ {
+				wait, err := bucket.take(config, conn, now)
+				c.Expect(err, IsNil)
+				c.Expect(wait, Equals, time.Duration(0))
+			}
+		})
+
+		c.Specify("waits for a token once the bucket is empty", func() {
+			bucket.take(config, conn, now)
+			bucket.take(config, conn, now)
+
+			wait, _ := bucket.take(config, conn, now)
+			c.Expect(wait.Seconds(), IsWithin(0.01), 0.5)
+		})
+
+		c.Specify("refills over time", func() {
+			bucket.take(config, conn, now)
+			bucket.take(config, conn, now)
+
+			wait, _ := bucket.take(config, conn, now+0.5)
+			c.Expect(wait, Equals, time.Duration(0))
+		})
+
+		c.Specify("reports its state", func() {
+			bucket.take(config, conn, now)
+
+			state, err := bucket.state(config, conn, now)
+			c.Expect(err, IsNil)
+			c.Expect(state.Name, Equals, "api")
+			c.Expect(state.Limit, Equals, 2)
+			c.Expect(state.Remaining, Equals, 1)
+			c.Expect(state.ResetIn, Equals, time.Duration(0))
+		})
+	})
+
+	c.Specify("SlidingWindow", func() {
+		window := &SlidingWindow{Name: "mail", Limit: 2, Window: 10 * time.Second}
+
+		c.Specify("allows Limit requests in the window", func() {
+			wait, _ := window.take(config, conn, now)
+			c.Expect(wait, Equals, time.Duration(0))
+			wait, _ = window.take(config, conn, now+1)
+			c.Expect(wait, Equals, time.Duration(0))
+		})
+
+		c.Specify("waits for the oldest request to leave the window", func() {
+			window.take(config, conn, now)
+			window.take(config, conn, now+1)
+
+			wait, _ := window.take(config, conn, now+2)
+			c.Expect(wait.Seconds(), IsWithin(0.01), 8.0)
+
+			wait, _ = window.take(config, conn, now+10.5)
+			c.Expect(wait, Equals, time.Duration(0))
+		})
+
+		c.Specify("reports its state", func() {
+			window.take(config, conn, now)
+			window.take(config, conn, now+1)
+
+			state, err := window.state(config, conn, now+2)
+			c.Expect(err, IsNil)
+			c.Expect(state.Remaining, Equals, 0)
+			c.Expect(state.ResetIn.Seconds(), IsWithin(0.01), 8.0)
+		})
+	})
+
+	c.Specify("MiddlewareRateLimit", func() {
+		wares := NewMiddleware(&MiddlewareRateLimit{config})
+		message, _ := NewMsg("{\"jid\":\"2\",\"class\":\"Mailer\",\"args\":[]}")
+		limited := withQueueRateLimiter(context.Background(), &SlidingWindow{Name: "queue", Limit: 1, Window: time.Minute})
+
+		ran := 0
+		job := func(context.Context) error {
+			ran++
+			return nil
+		}
+
+		c.Specify("runs jobs within the limit", func() {
+			err := wares.callContext(limited, "ratelimitqueue", message, job)
+			c.Expect(err, IsNil)
+			c.Expect(ran, Equals, 1)
+		})
+
+		c.Specify("reschedules jobs over the limit without retrying them", func() {
+			wares.callContext(limited, "ratelimitqueue", message, job)
+			err := wares.callContext(limited, "ratelimitqueue", message, job)
+			c.Expect(err, IsNil)
+			c.Expect(ran, Equals, 1)
+
+			scheduled, _ := redis.Strings(conn.Do("zrange", "prod:"+config.scheduledJobsQueue, 0, -1, "withscores"))
+			c.Expect(len(scheduled), Equals, 2)
+
+			rescheduled, _ := NewMsg(scheduled[0])
+			c.Expect(rescheduled.Jid(), Equals, "2")
+			c.Expect(rescheduled.Get("queue").MustString(), Equals, "ratelimitqueue")
+			c.Expect(rescheduled.Get("retry_count").Interface(), IsNil)
+
+			retries, _ := redis.Int(conn.Do("zcard", "prod:"+config.retryQueue))
+			c.Expect(retries, Equals, 0)
+		})
+
+		c.Specify("limits jobs by class", func() {
+			w.SetRateLimiter("Mailer", &SlidingWindow{Name: "class", Limit: 1, Window: time.Minute})
+
+			wares.callContext(context.Background(), "ratelimitqueue", message, job)
+			wares.callContext(context.Background(), "ratelimitqueue", message, job)
+			c.Expect(ran, Equals, 1)
+
+			other, _ := NewMsg("{\"jid\":\"3\",\"class\":\"Other\",\"args\":[]}")
+			wares.callContext(context.Background(), "ratelimitqueue", other, job)
+			c.Expect(ran, Equals, 2)
+		})
+	})
+
+	c.Specify("SetRateLimiter", func() {
+		c.Specify("names unnamed limiters after the class", func() {
+			bucket := &TokenBucket{Rate: 1, Interval: time.Second}
+			c.Expect(w.SetRateLimiter("Mailer", bucket), IsNil)
+			c.Expect(w.SetRateLimiter("Report", &SlidingWindow{Limit: 1, Window: time.Second}), IsNil)
+
+			c.Expect(config.rateLimiters.byClass["Mailer"].(*TokenBucket).Name, Equals, "Mailer")
+			c.Expect(config.rateLimiters.byClass["Report"].(*SlidingWindow).Name, Equals, "Report")
+			c.Expect(bucket.Name, Equals, "")
+		})
+
+		c.Specify("rejects invalid limits", func() {
+			c.Expect(w.SetRateLimiter("Mailer", &TokenBucket{Rate: 1}), Not(IsNil))
+			c.Expect(w.SetRateLimiter("Mailer", &TokenBucket{Rate: 0, Interval: time.Second}), Not(IsNil))
+			c.Expect(w.SetRateLimiter("Mailer", &SlidingWindow{Limit: 1}), Not(IsNil))
+			c.Expect(w.SetRateLimiter("Mailer", &SlidingWindow{Limit: -1, Window: time.Second}), Not(IsNil))
+
+			_, ok := config.rateLimiters.byClass["Mailer"]
+			c.Expect(ok, IsFalse)
+		})
+
+		c.Specify("names unnamed queue limiters after the queue", func() {
+			err := w.ProcessWithOptions("ratelimitqueue", func(context.Context, *Msg) error { return nil }, 1, ProcessOptions{
+				RateLimiter: &TokenBucket{Rate: 5, Interval: time.Second},
+			})
+			c.Expect(err, IsNil)
+			c.Expect(w.managers["ratelimitqueue"].options.RateLimiter.(*TokenBucket).Name, Equals, "queue:ratelimitqueue")
+
+			err = w.ProcessWithOptions("ratelimitqueue", func(context.Context, *Msg) error { return nil }, 1, ProcessOptions{
+				RateLimiter: &TokenBucket{Rate: 5},
+			})
+			c.Expect(err, Not(IsNil))
+		})
+	})
+
+	c.Specify("QueueStats reports the limiters", func() {
+		w.ProcessWithOptions("ratelimitqueue", func(context.Context, *Msg) error { return nil }, 1, ProcessOptions{
+			RateLimiter: &TokenBucket{Name: "queue", Rate: 5, Interval: time.Second},
+		})
+		w.SetRateLimiter("Mailer", &SlidingWindow{Name: "class", Limit: 3, Window: time.Minute})
+
+		stats, err := w.QueueStats()
+		c.Expect(err, IsNil)
+		c.Expect(len(stats.RateLimits), Equals, 2)
+		c.Expect(stats.RateLimits[0].Name, Equals, "class")
+		c.Expect(stats.RateLimits[0].Remaining, Equals, 3)
+		c.Expect(stats.RateLimits[1].Name, Equals, "queue")
+		c.Expect(stats.RateLimits[1].Limit, Equals, 5)
+	})
+}
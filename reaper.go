@@ -0,0 +1,155 @@
+package workers
+
+import (
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// How often to look for processes that died with messages in progress, in
+// seconds.
+const reaperInterval = heartbeatTTL
+
+// Moves the messages of the given inprogress lists of a process back to the
+// head of their queue and forgets the process, unless it still has a
+// heartbeat. Returns the number of messages moved, or false if the process is
+// alive.
+//
+// KEYS[1]: the heartbeat of the process
+// KEYS[2]: the hash of its inprogress lists and their queues
+// KEYS[3]: the set of processes with inprogress lists
+// KEYS[2i+2], KEYS[2i+3]: inprogress list i and its queue
+// ARGV[1]: the identity of the process
+var reapScript = redis.NewScript(-1, `
+if redis.call('exists', KEYS[1]) == 1 then
+	return false
+end
+local count = 0
+for i = 4, #KEYS, 2 do
+	local messages = redis.call('lrange', KEYS[i], 0, -1)
+	for j = 1, #messages do
+		redis.call('rpush', KEYS[i + 1], messages[j])
+	end
+	count = count + #messages
+	redis.call('del', KEYS[i])
+end
+redis.call('del', KEYS[2])
+redis.call('srem', KEYS[3], ARGV[1])
+return count
+`)
+
+// How many messages with an expired lease are requeued at once.
+const leaseSweepBatchSize = 100
+
+// reaper recovers messages stranded in the inprogress lists of processes
+// that crashed and came back, if at all, with another ProcessID, and leased
+// messages whose lease expired on any queue.
+type reaper struct {
+	config *config
+	closed chan bool
+}
+
+func (r *reaper) start() {
+	go (func() {
+		for {
+			r.reap()
+			r.requeueExpiredLeases()
+
+			select {
+			case <-r.closed:
+				return
+			case <-time.After(reaperInterval * time.Second):
+			}
+		}
+	})()
+}
+
+func (r *reaper) quit() {
+	close(r.closed)
+}
+
+func (r *reaper) reap() {
+	conn := r.config.Pool.Get()
+	defer conn.Close()
+
+	processes := r.config.NamespacedKey(inprogressProcessesSet)
+
+	identities, err := redis.Strings(conn.Do("smembers", processes))
+	if err != nil {
+		Logger.Println("ERR: ", err)
+		return
+	}
+
+	for _, identity := range identities {
+		if identity == r.config.identity {
+			continue
+		}
+
+		lists, err := redis.StringMap(conn.Do("hgetall", processInprogressKey(r.config, identity)))
+		if err != nil {
+			Logger.Println("ERR: ", err)
+			continue
+		}
+
+		keys := []interface{}{r.config.NamespacedKey(identity), processInprogressKey(r.config, identity), processes}
+		for list, queue := range lists {
+			// Processed by this process again, as it restarted with the
+			// same ProcessID.
+			if strings.HasSuffix(list, inprogressQueueKey(r.config, "")) {
+				continue
+			}
+			keys = append(keys, list, queue)
+		}
+
+		count, err := redis.Int(reapScript.Do(conn, append([]interface{}{len(keys)}, append(keys, identity)...)...))
+
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			Logger.Println("ERR: couldn't reap process", identity, ":", err)
+		} else {
+			Logger.Println("requeued", count, "in progress messages of dead process", identity)
+		}
+	}
+}
+
+// requeueExpiredLeases puts messages whose lease expired back on every known
+// queue, whether or not a process still fetches from it.
+func (r *reaper) requeueExpiredLeases() {
+	conn := r.config.Pool.Get()
+	defer conn.Close()
+
+	queues, err := redis.Strings(conn.Do("smembers", r.config.NamespacedKey("queues")))
+	if err != nil {
+		Logger.Println("ERR: ", err)
+		return
+	}
+
+	for _, name := range queues {
+		queue := r.config.NamespacedKey("queue", name)
+
+		for {
+			count, err := redis.Int(requeueExpiredLeasesScript.Do(conn,
+				leaseSetKey(queue),
+				queue,
+				nowToSecondsWithNanoPrecision(),
+				leaseSweepBatchSize,
+			))
+
+			if err != nil {
+				Logger.Println("ERR: couldn't requeue expired leases of", queue, ":", err)
+			} else if count > 0 {
+				Logger.Println("requeued", count, "messages with an expired lease for", queue)
+			}
+
+			if err != nil || count < leaseSweepBatchSize {
+				break
+			}
+		}
+	}
+}
+
+func newReaper(config *config) *reaper {
+	return &reaper{config, make(chan bool)}
+}
@@ -0,0 +1,105 @@
+package workers
+
+import (
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func ReaperSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	reaper := newReaper(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	// Registers process 2 as holding message in the inprogress list of
+	// reapqueue, as its heartbeat would.
+	strand := func(message string) {
+		conn.Do("sadd", "prod:inprogress:processes", "2")
+		conn.Do("hset", "prod:2:inprogress", "prod:queue:reapqueue:2:inprogress", "prod:queue:reapqueue")
+		conn.Do("lpush", "prod:queue:reapqueue:2:inprogress", message)
+	}
+
+	c.Specify("requeues messages of processes without a heartbeat", func() {
+		strand("{\"jid\":\"1\"}")
+		strand("{\"jid\":\"2\"}")
+		conn.Do("lpush", "prod:queue:reapqueue", "{\"jid\":\"3\"}")
+
+		reaper.reap()
+
+		messages, _ := redis.Strings(conn.Do("lrange", "prod:queue:reapqueue", 0, -1))
+		c.Expect(len(messages), Equals, 3)
+		c.Expect(messages[1], Equals, "{\"jid\":\"2\"}")
+		c.Expect(messages[2], Equals, "{\"jid\":\"1\"}")
+
+		inprogress, _ := redis.Bool(conn.Do("exists", "prod:queue:reapqueue:2:inprogress"))
+		registered, _ := redis.Bool(conn.Do("sismember", "prod:inprogress:processes", "2"))
+		lists, _ := redis.Bool(conn.Do("exists", "prod:2:inprogress"))
+		c.Expect(inprogress, IsFalse)
+		c.Expect(registered, IsFalse)
+		c.Expect(lists, IsFalse)
+	})
+
+	c.Specify("leaves processes with a heartbeat alone", func() {
+		strand("{\"jid\":\"1\"}")
+		conn.Do("hset", "prod:2", "beat", nowToSecondsWithNanoPrecision())
+
+		reaper.reap()
+
+		queued, _ := redis.Int(conn.Do("llen", "prod:queue:reapqueue"))
+		inprogress, _ := redis.Int(conn.Do("llen", "prod:queue:reapqueue:2:inprogress"))
+		c.Expect(queued, Equals, 0)
+		c.Expect(inprogress, Equals, 1)
+	})
+
+	c.Specify("leaves its own process alone", func() {
+		conn.Do("sadd", "prod:inprogress:processes", config.identity)
+		conn.Do("hset", "prod:"+config.identity+":inprogress", "prod:queue:reapqueue:1:inprogress", "prod:queue:reapqueue")
+		conn.Do("lpush", "prod:queue:reapqueue:1:inprogress", "{\"jid\":\"1\"}")
+
+		reaper.reap()
+
+		inprogress, _ := redis.Int(conn.Do("llen", "prod:queue:reapqueue:1:inprogress"))
+		c.Expect(inprogress, Equals, 1)
+	})
+
+	c.Specify("leaves the lists of an earlier run of its ProcessID alone", func() {
+		conn.Do("sadd", "prod:inprogress:processes", "earlier")
+		conn.Do("hset", "prod:earlier:inprogress", "prod:queue:reapqueue:1:inprogress", "prod:queue:reapqueue")
+		conn.Do("lpush", "prod:queue:reapqueue:1:inprogress", "{\"jid\":\"1\"}")
+
+		reaper.reap()
+
+		inprogress, _ := redis.Int(conn.Do("llen", "prod:queue:reapqueue:1:inprogress"))
+		registered, _ := redis.Bool(conn.Do("sismember", "prod:inprogress:processes", "earlier"))
+		c.Expect(inprogress, Equals, 1)
+		c.Expect(registered, IsFalse)
+	})
+
+	c.Specify("requeues messages whose lease expired on any queue", func() {
+		conn.Do("sadd", "prod:queues", "leasedqueue")
+		conn.Do("zadd", "prod:queue:leasedqueue:leases", nowToSecondsWithNanoPrecision()-1, "{\"jid\":\"1\"}")
+		conn.Do("zadd", "prod:queue:leasedqueue:leases", nowToSecondsWithNanoPrecision()+60, "{\"jid\":\"2\"}")
+
+		reaper.requeueExpiredLeases()
+
+		queued, _ := redis.Strings(conn.Do("lrange", "prod:queue:leasedqueue", 0, -1))
+		leased, _ := redis.Strings(conn.Do("zrange", "prod:queue:leasedqueue:leases", 0, -1))
+		c.Expect(len(queued), Equals, 1)
+		c.Expect(queued[0], Equals, "{\"jid\":\"1\"}")
+		c.Expect(len(leased), Equals, 1)
+		c.Expect(leased[0], Equals, "{\"jid\":\"2\"}")
+	})
+
+	c.Specify("finds the inprogress lists registered by heartbeats", func() {
+		m := newMultiQueueManager(config, []WeightedQueue{{"reapqueue", 1}, {"otherqueue", 1}}, StrictOrder, nil, 1)
+		newHeartbeat(config, []*manager{m}).beat()
+
+		registered, _ := redis.Bool(conn.Do("sismember", "prod:inprogress:processes", config.identity))
+		c.Expect(registered, IsTrue)
+
+		queue, _ := redis.String(conn.Do("hget", "prod:"+config.identity+":inprogress", "prod:queue:otherqueue:1:inprogress"))
+		c.Expect(queue, Equals, "prod:queue:otherqueue")
+	})
+}
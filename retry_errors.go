@@ -0,0 +1,74 @@
+package workers
+
+import (
+	"fmt"
+	"time"
+)
+
+// NonRetryableError makes MiddlewareRetry skip the job's remaining retries:
+// it goes straight to the dead set, or is dropped if it has retries disabled.
+type NonRetryableError struct {
+	Err error
+}
+
+// NonRetryable wraps err so the job isn't retried.
+func NonRetryable(err error) error {
+	return &NonRetryableError{err}
+}
+
+func (e *NonRetryableError) Error() string {
+	if e.Err == nil {
+		return "non-retryable error"
+	}
+	return e.Err.Error()
+}
+
+func (e *NonRetryableError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfterError makes MiddlewareRetry schedule the job's next retry after
+// Delay instead of the retry policy's delay. Jobs with retries disabled or
+// used up aren't retried.
+type RetryAfterError struct {
+	Err   error
+	Delay time.Duration
+}
+
+// RetryAfter wraps err so the job is retried after delay.
+func RetryAfter(delay time.Duration, err error) error {
+	return &RetryAfterError{err, delay}
+}
+
+func (e *RetryAfterError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("retry after %v", e.Delay)
+	}
+	return e.Err.Error()
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// DiscardError makes the job count as a success and be dropped without a
+// retry.
+type DiscardError struct {
+	Err error
+}
+
+// Discard wraps err, which may be nil, so the job is dropped silently.
+func Discard(err error) error {
+	return &DiscardError{err}
+}
+
+func (e *DiscardError) Error() string {
+	if e.Err == nil {
+		return "job discarded"
+	}
+	return e.Err.Error()
+}
+
+func (e *DiscardError) Unwrap() error {
+	return e.Err
+}
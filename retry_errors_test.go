@@ -0,0 +1,115 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func RetryErrorsSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	wares := NewMiddleware(&MiddlewareRetry{config}, &MiddlewareStats{config})
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	failWith := func(err error) func(context.Context) error {
+		return func(context.Context) error {
+			return err
+		}
+	}
+
+	counts := func() (retries, dead, failed int) {
+		retries, _ = redis.Int(conn.Do("zcard", "prod:"+config.retryQueue))
+		dead, _ = redis.Int(conn.Do("zcard", "prod:dead"))
+		failed, _ = redis.Int(conn.Do("get", "prod:stat:failed"))
+		return
+	}
+
+	c.Specify("NonRetryable", func() {
+		c.Specify("sends a retryable job straight to the dead set", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true}")
+
+			err := wares.callContext(context.Background(), "myqueue", message, failWith(NonRetryable(errors.New("bad input"))))
+			c.Expect(err, IsNil)
+
+			retries, dead, failed := counts()
+			c.Expect(retries, Equals, 0)
+			c.Expect(dead, Equals, 1)
+			c.Expect(failed, Equals, 1)
+		})
+
+		c.Specify("drops a job without retries", func() {
+			message, _ := NewMsg("{\"jid\":\"2\"}")
+
+			err := wares.callContext(context.Background(), "myqueue", message, failWith(NonRetryable(errors.New("bad input"))))
+			c.Expect(err, IsNil)
+
+			retries, dead, _ := counts()
+			c.Expect(retries, Equals, 0)
+			c.Expect(dead, Equals, 0)
+		})
+
+		c.Specify("is found when wrapped", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true}")
+			wrapped := fmt.Errorf("syncing: %w", NonRetryable(errors.New("bad input")))
+
+			wares.callContext(context.Background(), "myqueue", message, failWith(wrapped))
+
+			_, dead, _ := counts()
+			c.Expect(dead, Equals, 1)
+		})
+	})
+
+	c.Specify("RetryAfter", func() {
+		c.Specify("schedules the retry after the requested delay", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true}")
+
+			err := wares.callContext(context.Background(), "myqueue", message, failWith(RetryAfter(10*time.Minute, errors.New("rate limited"))))
+			c.Expect(err, IsNil)
+
+			score, _ := redis.Float64(conn.Do("zscore", "prod:"+config.retryQueue, message.ToJson()))
+			c.Expect(score, IsWithin(1), nowToSecondsWithNanoPrecision()+600)
+		})
+
+		c.Specify("still gives up when retries are used up", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true,\"retry_count\":25}")
+
+			wares.callContext(context.Background(), "myqueue", message, failWith(RetryAfter(time.Minute, errors.New("rate limited"))))
+
+			retries, dead, _ := counts()
+			c.Expect(retries, Equals, 0)
+			c.Expect(dead, Equals, 1)
+		})
+
+		c.Specify("drops a job without retries", func() {
+			message, _ := NewMsg("{\"jid\":\"2\"}")
+
+			err := wares.callContext(context.Background(), "myqueue", message, failWith(RetryAfter(time.Minute, errors.New("rate limited"))))
+			c.Expect(err, IsNil)
+
+			retries, dead, _ := counts()
+			c.Expect(retries, Equals, 0)
+			c.Expect(dead, Equals, 0)
+		})
+	})
+
+	c.Specify("Discard", func() {
+		c.Specify("drops the job as a success", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true}")
+
+			err := wares.callContext(context.Background(), "myqueue", message, failWith(fmt.Errorf("stale: %w", Discard(nil))))
+			c.Expect(err, IsNil)
+
+			retries, dead, failed := counts()
+			c.Expect(retries, Equals, 0)
+			c.Expect(dead, Equals, 0)
+			c.Expect(failed, Equals, 0)
+		})
+	})
+}
@@ -0,0 +1,174 @@
+package workers
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy decides when a failed job is retried and when to stop. Retry
+// counts start at 0 for the first retry.
+type RetryPolicy interface {
+	// Delay returns how long to wait before retry number retryCount.
+	Delay(retryCount int) time.Duration
+	// GiveUp reports whether a job already retried retryCount times should
+	// be sent to the dead set instead of being retried again.
+	GiveUp(retryCount int) bool
+}
+
+// DefaultRetryPolicy is Sidekiq's backoff: retryCount^4 + 15 seconds plus
+// random jitter, for up to DEFAULT_MAX_RETRY retries.
+var DefaultRetryPolicy RetryPolicy = sidekiqBackoff{}
+
+type sidekiqBackoff struct{}
+
+func (sidekiqBackoff) Delay(retryCount int) time.Duration {
+	return time.Duration(secondsToDelay(retryCount)) * time.Second
+}
+
+func (sidekiqBackoff) GiveUp(retryCount int) bool {
+	return retryCount >= DEFAULT_MAX_RETRY
+}
+
+// ExponentialBackoff waits Base * Factor^retryCount, Factor defaulting to 2.
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Factor float64
+	// MaxRetries defaults to DEFAULT_MAX_RETRY when zero.
+	MaxRetries int
+	// Jitter adds up to this fraction of the delay at random, e.g. 0.1.
+	Jitter float64
+}
+
+func (b *ExponentialBackoff) Delay(retryCount int) time.Duration {
+	factor := b.Factor
+	if factor == 0 {
+		factor = 2
+	}
+
+	return withJitter(time.Duration(float64(b.Base)*math.Pow(factor, float64(retryCount))), b.Jitter)
+}
+
+func (b *ExponentialBackoff) GiveUp(retryCount int) bool {
+	return giveUpAfter(b.MaxRetries, retryCount)
+}
+
+// LinearBackoff waits Step * (retryCount + 1).
+type LinearBackoff struct {
+	Step time.Duration
+	// MaxRetries defaults to DEFAULT_MAX_RETRY when zero.
+	MaxRetries int
+	// Jitter adds up to this fraction of the delay at random, e.g. 0.1.
+	Jitter float64
+}
+
+func (b *LinearBackoff) Delay(retryCount int) time.Duration {
+	return withJitter(b.Step*time.Duration(retryCount+1), b.Jitter)
+}
+
+func (b *LinearBackoff) GiveUp(retryCount int) bool {
+	return giveUpAfter(b.MaxRetries, retryCount)
+}
+
+// ConstantBackoff always waits Interval.
+type ConstantBackoff struct {
+	Interval time.Duration
+	// MaxRetries defaults to DEFAULT_MAX_RETRY when zero.
+	MaxRetries int
+	// Jitter adds up to this fraction of the delay at random, e.g. 0.1.
+	Jitter float64
+}
+
+func (b *ConstantBackoff) Delay(retryCount int) time.Duration {
+	return withJitter(b.Interval, b.Jitter)
+}
+
+func (b *ConstantBackoff) GiveUp(retryCount int) bool {
+	return giveUpAfter(b.MaxRetries, retryCount)
+}
+
+// CappedBackoff limits the delay of another policy to Max.
+type CappedBackoff struct {
+	Policy RetryPolicy
+	Max    time.Duration
+}
+
+func (b *CappedBackoff) Delay(retryCount int) time.Duration {
+	if delay := b.Policy.Delay(retryCount); delay < b.Max {
+		return delay
+	}
+
+	return b.Max
+}
+
+func (b *CappedBackoff) GiveUp(retryCount int) bool {
+	return b.Policy.GiveUp(retryCount)
+}
+
+func withJitter(delay time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 || delay <= 0 {
+		return delay
+	}
+
+	return delay + time.Duration(rand.Float64()*jitter*float64(delay))
+}
+
+func giveUpAfter(maxRetries, retryCount int) bool {
+	if maxRetries == 0 {
+		maxRetries = DEFAULT_MAX_RETRY
+	}
+
+	return retryCount >= maxRetries
+}
+
+// retryPolicies holds the policies registered per job class.
+type retryPolicies struct {
+	sync.RWMutex
+	byClass map[string]RetryPolicy
+}
+
+// SetRetryPolicy makes jobs of class use policy, whatever queue they're on.
+func (w *Workers) SetRetryPolicy(class string, policy RetryPolicy) {
+	w.config.retryPolicies.Lock()
+	defer w.config.retryPolicies.Unlock()
+
+	w.config.retryPolicies.byClass[class] = policy
+}
+
+type queueRetryPolicyKey struct{}
+
+// withQueueRetryPolicy records the retry policy of the queue a job was
+// fetched from on its context.
+func withQueueRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	if policy == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, queueRetryPolicyKey{}, policy)
+}
+
+// retryPolicyFor returns the policy for message: its class's policy, else
+// its queue's, else the global one.
+func (c *config) retryPolicyFor(ctx context.Context, message *Msg) RetryPolicy {
+	if class, err := message.Get("class").String(); err == nil {
+		c.retryPolicies.RLock()
+		policy, ok := c.retryPolicies.byClass[class]
+		c.retryPolicies.RUnlock()
+
+		if ok {
+			return policy
+		}
+	}
+
+	if policy, ok := ctx.Value(queueRetryPolicyKey{}).(RetryPolicy); ok {
+		return policy
+	}
+
+	if c.RetryPolicy != nil {
+		return c.RetryPolicy
+	}
+
+	return DefaultRetryPolicy
+}
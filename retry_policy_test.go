@@ -0,0 +1,126 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func RetryPolicySpec(c gospec.Context) {
+	config := mkDefaultConfig()
+
+	c.Specify("ExponentialBackoff", func() {
+		policy := &ExponentialBackoff{Base: time.Second, MaxRetries: 3}
+
+		c.Expect(policy.Delay(0), Equals, time.Second)
+		c.Expect(policy.Delay(3), Equals, 8*time.Second)
+		c.Expect(policy.GiveUp(2), IsFalse)
+		c.Expect(policy.GiveUp(3), IsTrue)
+	})
+
+	c.Specify("LinearBackoff", func() {
+		policy := &LinearBackoff{Step: time.Second}
+
+		c.Expect(policy.Delay(0), Equals, time.Second)
+		c.Expect(policy.Delay(4), Equals, 5*time.Second)
+		c.Expect(policy.GiveUp(DEFAULT_MAX_RETRY-1), IsFalse)
+		c.Expect(policy.GiveUp(DEFAULT_MAX_RETRY), IsTrue)
+	})
+
+	c.Specify("ConstantBackoff", func() {
+		policy := &ConstantBackoff{Interval: time.Minute}
+
+		c.Expect(policy.Delay(0), Equals, time.Minute)
+		c.Expect(policy.Delay(10), Equals, time.Minute)
+	})
+
+	c.Specify("CappedBackoff", func() {
+		policy := &CappedBackoff{&ExponentialBackoff{Base: time.Second, MaxRetries: 3}, 5 * time.Second}
+
+		c.Expect(policy.Delay(1), Equals, 2*time.Second)
+		c.Expect(policy.Delay(10), Equals, 5*time.Second)
+		c.Expect(policy.GiveUp(3), IsTrue)
+	})
+
+	c.Specify("jitter stays within its fraction of the delay", func() {
+		policy := &ConstantBackoff{Interval: time.Second, Jitter: 0.5}
+
+		for i := 0; i < 100; i++ {
+			delay := policy.Delay(0)
+			c.Expect(delay >= time.Second && delay <= 1500*time.Millisecond, IsTrue)
+		}
+	})
+
+	c.Specify("retryPolicyFor", func() {
+		message, _ := NewMsg("{\"jid\":\"2\",\"class\":\"Export\"}")
+		global := &ConstantBackoff{Interval: time.Second}
+		queue := &ConstantBackoff{Interval: 2 * time.Second}
+		class := &ConstantBackoff{Interval: 3 * time.Second}
+
+		c.Specify("defaults to the Sidekiq policy", func() {
+			c.Expect(config.retryPolicyFor(context.Background(), message), Equals, DefaultRetryPolicy)
+		})
+
+		c.Specify("uses the global policy", func() {
+			config.RetryPolicy = global
+			c.Expect(config.retryPolicyFor(context.Background(), message), Equals, global)
+		})
+
+		c.Specify("prefers the queue policy", func() {
+			config.RetryPolicy = global
+			ctx := withQueueRetryPolicy(context.Background(), queue)
+			c.Expect(config.retryPolicyFor(ctx, message), Equals, queue)
+		})
+
+		c.Specify("prefers the class policy", func() {
+			mkWorkers(config).SetRetryPolicy("Export", class)
+			ctx := withQueueRetryPolicy(context.Background(), queue)
+			c.Expect(config.retryPolicyFor(ctx, message), Equals, class)
+		})
+	})
+
+	c.Specify("MiddlewareRetry", func() {
+		wares := NewMiddleware(&MiddlewareRetry{config})
+		ctx := withQueueRetryPolicy(context.Background(), &ConstantBackoff{Interval: time.Hour, MaxRetries: 2})
+
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		failing := func(context.Context) error {
+			return errors.New("AHHHH")
+		}
+
+		c.Specify("schedules the retry after the policy's delay", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true}")
+
+			wares.callContext(ctx, "myqueue", message, failing)
+
+			score, _ := redis.Float64(conn.Do("zscore", "prod:"+config.retryQueue, message.ToJson()))
+			c.Expect(score, IsWithin(1), nowToSecondsWithNanoPrecision()+3600)
+		})
+
+		c.Specify("gives up when the policy says so", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"retry\":true,\"retry_count\":2}")
+
+			wares.callContext(ctx, "myqueue", message, failing)
+
+			retries, _ := redis.Int(conn.Do("zcard", "prod:"+config.retryQueue))
+			dead, _ := redis.Int(conn.Do("zcard", "prod:dead"))
+			c.Expect(retries, Equals, 0)
+			c.Expect(dead, Equals, 1)
+		})
+
+		c.Specify("lets a numeric retry on the message override the policy's maximum", func() {
+			message, _ := NewMsg("{\"jid\":\"2\",\"retry\":5,\"retry_count\":2}")
+
+			wares.callContext(ctx, "myqueue", message, failing)
+
+			retries, _ := redis.Int(conn.Do("zcard", "prod:"+config.retryQueue))
+			c.Expect(retries, Equals, 1)
+		})
+	})
+}
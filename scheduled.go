@@ -1,66 +1,425 @@
 package workers
 
 import (
+	"math/rand"
+	"strconv"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
+// How many due messages are moved at once.
+const scheduledBatchSize = 100
+
+// Moves due messages from a sorted set to their queues, skipping messages
+// another process moved first. Messages that couldn't be parsed go to the dead
+// set.
+//
+// KEYS[1]: the sorted set
+// KEYS[2]: the dead set
+// ARGV[1]: the current time
+// ARGV[2..]: triples of the message in the set, the message to enqueue and
+// the queue to push it to, or two empty strings for the dead set
+var enqueueDueScript = redis.NewScript(2, `
+local moved = 0
+for i = 2, #ARGV, 3 do
+	if redis.call('zrem', KEYS[1], ARGV[i]) == 1 then
+		if ARGV[i + 2] == '' then
+			redis.call('zadd', KEYS[2], ARGV[1], ARGV[i])
+		else
+			redis.call('lpush', ARGV[i + 2], ARGV[i + 1])
+			moved = moved + 1
+		end
+	end
+end
+return moved
+`)
+
+const (
+	// Holds the ProcessID of the process polling with SinglePoller.
+	pollerKey = "poller"
+	// How many poll intervals the poller stays elected without polling.
+	pollerTermIntervals = 3
+	// Pub/sub channel announcing when a newly scheduled message is due.
+	wakeupChannel = "wakeup"
+	// Shortest time the poller sleeps, so it doesn't spin on messages it
+	// failed to move.
+	scheduledMinWait = 10 * time.Millisecond
+	// Longest random delay per other live process added when waking up for a
+	// due message, so processes don't all poll at the same time.
+	scheduledWakeJitter = 1 * time.Second
+)
+
+// Makes ARGV[1] the poller for ARGV[2] seconds, unless another process is.
+// Returns 1 when ARGV[1] is the poller.
+//
+// KEYS[1]: the poller key
+var electPollerScript = redis.NewScript(1, `
+local poller = redis.call('get', KEYS[1])
+if poller == false or poller == ARGV[1] then
+	redis.call('set', KEYS[1], ARGV[1], 'ex', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// Stops ARGV[1] being the poller.
+//
+// KEYS[1]: the poller key
+var resignPollerScript = redis.NewScript(1, `
+if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('del', KEYS[1])
+end
+return 0
+`)
+
+// Adds a message to a sorted set, and publishes its score as a wake-up
+// notification if it's now the first message of the set.
+//
+// KEYS[1]: the sorted set
+// ARGV[1]: the wake-up channel
+// ARGV[2]: the score
+// ARGV[3]: the message
+var scheduleScript = redis.NewScript(1, `
+redis.call('zadd', KEYS[1], ARGV[2], ARGV[3])
+local first = redis.call('zrange', KEYS[1], 0, 0)
+if first[1] == ARGV[3] then
+	redis.call('publish', ARGV[1], ARGV[2])
+end
+return 1
+`)
+
+// scheduleMessage adds message to the sorted set key, to be enqueued at the
+// time given in seconds, waking up pollers if it's due before any other
+// message of the set.
+func scheduleMessage(config *config, conn redis.Conn, key string, at float64, message []byte) error {
+	_, err := scheduleScript.Do(conn, config.NamespacedKey(key), config.NamespacedKey(wakeupChannel), at, message)
+	return err
+}
+
+func secondsToTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*NanoSecondPrecision))
+}
+
 type scheduled struct {
-	config *config
-	keys   []string
-	closed chan bool
-	exit   chan bool
+	config  *config
+	keys    []string
+	closed  chan bool
+	exit    chan bool
+	wakeups chan float64
 }
 
 func (s *scheduled) start() {
+	go s.listen()
+
 	go (func() {
 		for {
+			polling := !s.config.SinglePoller || s.elect()
+			if polling {
+				s.poll()
+			}
+
+			// Only pollers wake up early for due messages.
+			wait := s.pollInterval()
+			jitter := time.Duration(0)
+			if polling {
+				jitter = s.wakeJitter()
+				if due, ok := s.nextDue(); ok && due+jitter < wait {
+					wait = due + jitter
+				}
+			}
+
+			if !s.sleep(wait, polling, jitter) {
+				if s.config.SinglePoller {
+					s.resign()
+				}
+				return
+			}
+		}
+	})()
+}
+
+func (s *scheduled) quit() {
+	close(s.closed)
+}
+
+// sleep waits for wait, or if early is set until jitter after a message is
+// scheduled before then. Returns false if the poller was quit.
+func (s *scheduled) sleep(wait time.Duration, early bool, jitter time.Duration) bool {
+	if wait < scheduledMinWait {
+		wait = scheduledMinWait
+	}
+
+	deadline := time.Now().Add(wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return false
+		case <-timer.C:
+			return true
+		case at := <-s.wakeups:
+			if !early {
+				continue
+			}
+
+			due := time.Until(secondsToTime(at)) + jitter
+			if due >= time.Until(deadline) {
+				continue
+			}
+			if due < scheduledMinWait {
+				due = scheduledMinWait
+			}
+
+			if !timer.Stop() {
+				<-timer.C
+			}
+			deadline = time.Now().Add(due)
+			timer.Reset(due)
+		}
+	}
+}
+
+// nextDue returns how long until the earliest message of the sets is due.
+func (s *scheduled) nextDue() (due time.Duration, ok bool) {
+	conn := s.config.Pool.Get()
+	defer conn.Close()
+
+	for _, key := range s.keys {
+		reply, err := redis.Strings(conn.Do("zrange", s.config.NamespacedKey(key), 0, 0, "withscores"))
+		if err != nil {
+			Logger.Println("ERR: ", err)
+			continue
+		}
+
+		if len(reply) < 2 {
+			continue
+		}
+
+		at, err := strconv.ParseFloat(reply[1], 64)
+		if err != nil {
+			continue
+		}
+
+		if next := time.Until(secondsToTime(at)); !ok || next < due {
+			due, ok = next, true
+		}
+	}
+
+	return
+}
+
+// listen passes the times of wake-up notifications to s.wakeups until the
+// poller is quit.
+func (s *scheduled) listen() {
+	for {
+		if s.config.Pool.Dial == nil {
+			Logger.Println("ERR: the redis pool has no Dial func, scheduled messages are only enqueued when polled.")
+			return
+		}
+
+		if conn, err := s.config.Pool.Dial(); err != nil {
+			Logger.Println("ERR: ", err)
+		} else {
+			s.receiveWakeups(conn)
+		}
+
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+func (s *scheduled) receiveWakeups(conn redis.Conn) {
+	done := make(chan bool)
+	defer close(done)
+
+	// Closing the connection interrupts Receive.
+	go (func() {
+		select {
+		case <-s.closed:
+		case <-done:
+		}
+		conn.Close()
+	})()
+
+	pubsub := redis.PubSubConn{Conn: conn}
+	if err := pubsub.Subscribe(s.config.NamespacedKey(wakeupChannel)); err != nil {
+		Logger.Println("ERR: ", err)
+		return
+	}
+
+	for {
+		switch reply := pubsub.Receive().(type) {
+		case redis.Message:
+			at, err := strconv.ParseFloat(string(reply.Data), 64)
+			if err != nil {
+				continue
+			}
+
 			select {
+			case s.wakeups <- at:
 			case <-s.closed:
 				return
+			}
+		case error:
+			select {
+			case <-s.closed:
 			default:
+				Logger.Println("ERR: ", reply)
 			}
+			return
+		}
+	}
+}
 
-			s.poll()
+// pollInterval returns a random interval between half and one and a half
+// times PollInterval, times the number of live processes unless a single
+// process polls.
+func (s *scheduled) pollInterval() time.Duration {
+	interval := float64(s.config.PollInterval)
+
+	if !s.config.SinglePoller {
+		interval *= float64(s.liveProcesses())
+	}
 
-			time.Sleep(time.Duration(s.config.PollInterval) * time.Second)
+	return time.Duration((interval*rand.Float64() + interval/2) * float64(time.Second))
+}
+
+// liveProcesses counts the processes with a heartbeat, at least this one.
+func (s *scheduled) liveProcesses() int {
+	conn := s.config.Pool.Get()
+	defer conn.Close()
+
+	identities, err := redis.Strings(conn.Do("smembers", s.config.NamespacedKey("processes")))
+	if err != nil {
+		Logger.Println("ERR: ", err)
+		return 1
+	}
+
+	for _, identity := range identities {
+		conn.Send("exists", s.config.NamespacedKey(identity))
+	}
+
+	live := 0
+	if err := conn.Flush(); err != nil {
+		Logger.Println("ERR: ", err)
+		return 1
+	}
+
+	for range identities {
+		if exists, _ := redis.Bool(conn.Receive()); exists {
+			live++
 		}
-	})()
+	}
+
+	if live == 0 {
+		return 1
+	}
+
+	return live
 }
 
-func (s *scheduled) quit() {
-	close(s.closed)
+// wakeJitter returns a random delay of up to scheduledWakeJitter per other
+// live process. It's zero with a single poller, which polls alone.
+func (s *scheduled) wakeJitter() time.Duration {
+	if s.config.SinglePoller {
+		return 0
+	}
+
+	others := s.liveProcesses() - 1
+	return time.Duration(rand.Float64() * float64(others) * float64(scheduledWakeJitter))
+}
+
+// elect makes this process the poller if there's none, or extends its term
+// if it already is. Returns whether this process is the poller.
+func (s *scheduled) elect() bool {
+	conn := s.config.Pool.Get()
+	defer conn.Close()
+
+	elected, err := redis.Bool(electPollerScript.Do(conn,
+		s.config.NamespacedKey(pollerKey),
+		s.config.processId,
+		pollerTermIntervals*s.config.PollInterval,
+	))
+	if err != nil {
+		Logger.Println("ERR: ", err)
+	}
+
+	return elected
+}
+
+// resign lets another process become the poller straight away.
+func (s *scheduled) resign() {
+	conn := s.config.Pool.Get()
+	defer conn.Close()
+
+	if _, err := resignPollerScript.Do(conn, s.config.NamespacedKey(pollerKey), s.config.processId); err != nil {
+		Logger.Println("ERR: ", err)
+	}
 }
 
-func (s *scheduled) poll() {
+// poll moves every due message to its queue, in batches.
+func (s *scheduled) poll() (err error) {
 	conn := s.config.Pool.Get()
+	defer conn.Close()
 
 	now := nowToSecondsWithNanoPrecision()
 
 	for _, key := range s.keys {
-		key = s.config.NamespacedKey(key)
-		for {
-			messages, _ := redis.Strings(conn.Do("zrangebyscore", key, "-inf", now, "limit", 0, 1))
+		if pollErr := s.enqueueDue(conn, s.config.NamespacedKey(key), now); pollErr != nil {
+			Logger.Println("ERR: couldn't enqueue due messages from", key, ":", pollErr)
+			err = pollErr
+		}
+	}
 
-			if len(messages) == 0 {
-				break
-			}
+	return
+}
+
+// enqueueDue moves the messages of key due by now until there's none left.
+func (s *scheduled) enqueueDue(conn redis.Conn, key string, now float64) error {
+	for {
+		messages, err := redis.Strings(conn.Do("zrangebyscore", key, "-inf", now, "limit", 0, scheduledBatchSize))
+		if err != nil {
+			return err
+		}
+
+		if len(messages) == 0 {
+			return nil
+		}
 
-			message, _ := NewMsg(messages[0])
+		args := make([]interface{}, 0, 3+3*len(messages))
+		args = append(args, key, s.config.NamespacedKey(s.config.deadSet), now)
 
-			if removed, _ := redis.Bool(conn.Do("zrem", key, messages[0])); removed {
-				queue, _ := message.Get("queue").String()
-				queue = s.config.TrimKeyNamespace(queue)
-				message.Set("enqueued_at", nowToSecondsWithNanoPrecision())
-				conn.Do("lpush", s.config.NamespacedKey("queue", queue), message.ToJson())
+		for _, message := range messages {
+			msg, err := NewMsg(message)
+			if err != nil {
+				Logger.Println("ERR: couldn't parse", message, ", moving it to the dead set:", err)
+				args = append(args, message, "", "")
+				continue
 			}
+
+			queue, _ := msg.Get("queue").String()
+			queue = s.config.TrimKeyNamespace(queue)
+			msg.Set("enqueued_at", nowToSecondsWithNanoPrecision())
+
+			args = append(args, message, msg.ToJson(), s.config.NamespacedKey("queue", queue))
 		}
-	}
 
-	conn.Close()
+		if _, err := enqueueDueScript.Do(conn, args...); err != nil {
+			return err
+		}
+
+		if len(messages) < scheduledBatchSize {
+			return nil
+		}
+	}
 }
 
 func newScheduled(config *config, keys ...string) *scheduled {
-	return &scheduled{config, keys, make(chan bool), make(chan bool)}
+	return &scheduled{config, keys, make(chan bool), make(chan bool), make(chan float64)}
 }
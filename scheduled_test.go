@@ -1,6 +1,9 @@
 package workers
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/customerio/gospec"
 	. "github.com/customerio/gospec"
 	"github.com/garyburd/redigo/redis"
@@ -36,4 +39,227 @@ func ScheduledSpec(c gospec.Context) {
 		c.Expect(myqueueCount, Equals, 1)
 		c.Expect(pending, Equals, 1)
 	})
+
+	c.Specify("moves more due messages than fit in a batch", func() {
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		now := nowToSecondsWithNanoPrecision()
+
+		for i := 0; i < 2*scheduledBatchSize+50; i++ {
+			conn.Do("zadd", "prod:"+config.retryQueue, now-60.0, fmt.Sprintf("{\"queue\":\"batchqueue\",\"jid\":\"%d\"}", i))
+		}
+
+		c.Expect(scheduled.poll(), IsNil)
+
+		count, _ := redis.Int(conn.Do("llen", "prod:queue:batchqueue"))
+		pending, _ := redis.Int(conn.Do("zcard", "prod:"+config.retryQueue))
+
+		c.Expect(count, Equals, 2*scheduledBatchSize+50)
+		c.Expect(pending, Equals, 0)
+	})
+
+	c.Specify("sets when messages were enqueued", func() {
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		conn.Do("zadd", "prod:"+config.retryQueue, nowToSecondsWithNanoPrecision()-60.0, "{\"queue\":\"default\",\"jid\":\"1\"}")
+
+		scheduled.poll()
+
+		queued, _ := redis.String(conn.Do("rpop", "prod:queue:default"))
+		message, _ := NewMsg(queued)
+		enqueuedAt, _ := message.Get("enqueued_at").Float64()
+
+		c.Expect(enqueuedAt, IsWithin(1), nowToSecondsWithNanoPrecision())
+	})
+
+	c.Specify("moves messages it can't parse to the dead set", func() {
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		now := nowToSecondsWithNanoPrecision()
+
+		conn.Do("zadd", "prod:"+config.retryQueue, now-60.0, "not json")
+		conn.Do("zadd", "prod:"+config.retryQueue, now-10.0, "{\"queue\":\"default\",\"jid\":\"1\"}")
+
+		c.Expect(scheduled.poll(), IsNil)
+
+		dead, _ := redis.Strings(conn.Do("zrange", "prod:dead", 0, -1))
+		defaultCount, _ := redis.Int(conn.Do("llen", "prod:queue:default"))
+
+		c.Expect(len(dead), Equals, 1)
+		c.Expect(dead[0], Equals, "not json")
+		c.Expect(defaultCount, Equals, 1)
+	})
+
+	c.Specify("pollInterval", func() {
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		config.PollInterval = 10
+		defer (func() { config.PollInterval = 15 })()
+
+		c.Specify("averages the poll interval", func() {
+			for i := 0; i < 20; i++ {
+				c.Expect(scheduled.pollInterval().Seconds(), IsWithin(5), 10.0)
+			}
+		})
+
+		c.Specify("scales with the number of live processes", func() {
+			conn.Do("sadd", "prod:processes", "1", "2", "3")
+			conn.Do("hset", "prod:1", "beat", nowToSecondsWithNanoPrecision())
+			conn.Do("hset", "prod:2", "beat", nowToSecondsWithNanoPrecision())
+
+			for i := 0; i < 20; i++ {
+				c.Expect(scheduled.pollInterval().Seconds(), IsWithin(10), 20.0)
+			}
+		})
+
+		c.Specify("doesn't scale with a single poller", func() {
+			config.SinglePoller = true
+			defer (func() { config.SinglePoller = false })()
+
+			conn.Do("sadd", "prod:processes", "1", "2")
+			conn.Do("hset", "prod:1", "beat", nowToSecondsWithNanoPrecision())
+			conn.Do("hset", "prod:2", "beat", nowToSecondsWithNanoPrecision())
+
+			for i := 0; i < 20; i++ {
+				c.Expect(scheduled.pollInterval().Seconds(), IsWithin(5), 10.0)
+			}
+		})
+	})
+
+	c.Specify("wakeJitter", func() {
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		c.Specify("is zero for a single process", func() {
+			c.Expect(scheduled.wakeJitter(), Equals, time.Duration(0))
+		})
+
+		c.Specify("spreads the other live processes", func() {
+			conn.Do("sadd", "prod:processes", "1", "2", "3")
+			conn.Do("hset", "prod:1", "beat", nowToSecondsWithNanoPrecision())
+			conn.Do("hset", "prod:2", "beat", nowToSecondsWithNanoPrecision())
+			conn.Do("hset", "prod:3", "beat", nowToSecondsWithNanoPrecision())
+
+			for i := 0; i < 20; i++ {
+				c.Expect(scheduled.wakeJitter().Seconds(), IsWithin(1), 1.0)
+			}
+		})
+
+		c.Specify("is zero with a single poller", func() {
+			config.SinglePoller = true
+			defer (func() { config.SinglePoller = false })()
+
+			conn.Do("sadd", "prod:processes", "1", "2")
+			conn.Do("hset", "prod:1", "beat", nowToSecondsWithNanoPrecision())
+			conn.Do("hset", "prod:2", "beat", nowToSecondsWithNanoPrecision())
+
+			c.Expect(scheduled.wakeJitter(), Equals, time.Duration(0))
+		})
+	})
+
+	c.Specify("only wakes up early for due messages when polling", func() {
+		sleeper := newScheduled(config, config.scheduledJobsQueue)
+		at := nowToSecondsWithNanoPrecision()
+
+		go (func() { sleeper.wakeups <- at })()
+
+		start := time.Now()
+		sleeper.sleep(300*time.Millisecond, false, 0)
+		c.Expect(time.Since(start) >= 300*time.Millisecond, IsTrue)
+
+		go (func() { sleeper.wakeups <- at })()
+
+		start = time.Now()
+		sleeper.sleep(300*time.Millisecond, true, 0)
+		c.Expect(time.Since(start) < 300*time.Millisecond, IsTrue)
+	})
+
+	c.Specify("elects a single poller", func() {
+		otherConfig := *config
+		otherConfig.processId = "2"
+		other := newScheduled(&otherConfig, config.retryQueue)
+
+		c.Expect(scheduled.elect(), IsTrue)
+		c.Expect(other.elect(), IsFalse)
+		c.Expect(scheduled.elect(), IsTrue)
+
+		scheduled.resign()
+
+		c.Expect(other.elect(), IsTrue)
+		c.Expect(scheduled.elect(), IsFalse)
+	})
+
+	c.Specify("nextDue", func() {
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		both := newScheduled(config, config.retryQueue, config.scheduledJobsQueue)
+		now := nowToSecondsWithNanoPrecision()
+
+		c.Specify("is not ok when nothing is scheduled", func() {
+			_, ok := both.nextDue()
+			c.Expect(ok, IsFalse)
+		})
+
+		c.Specify("is the time until the earliest message of every set", func() {
+			conn.Do("zadd", "prod:"+config.retryQueue, now+60.0, "{\"jid\":\"1\"}")
+			conn.Do("zadd", "prod:"+config.scheduledJobsQueue, now+30.0, "{\"jid\":\"2\"}")
+			conn.Do("zadd", "prod:"+config.scheduledJobsQueue, now+90.0, "{\"jid\":\"3\"}")
+
+			due, ok := both.nextDue()
+			c.Expect(ok, IsTrue)
+			c.Expect(due.Seconds(), IsWithin(1), 30.0)
+		})
+	})
+
+	c.Specify("scheduleMessage publishes a wake-up for the earliest message", func() {
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		subscriber, _ := config.Pool.Dial()
+		defer subscriber.Close()
+
+		pubsub := redis.PubSubConn{Conn: subscriber}
+		pubsub.Subscribe("prod:wakeup")
+		pubsub.Receive()
+
+		now := nowToSecondsWithNanoPrecision()
+
+		scheduleMessage(config, conn, config.scheduledJobsQueue, now+60, []byte("{\"jid\":\"1\"}"))
+		scheduleMessage(config, conn, config.scheduledJobsQueue, now+90, []byte("{\"jid\":\"2\"}"))
+		scheduleMessage(config, conn, config.scheduledJobsQueue, now+30, []byte("{\"jid\":\"3\"}"))
+
+		first, _ := pubsub.Receive().(redis.Message)
+		second, _ := pubsub.Receive().(redis.Message)
+
+		c.Expect(string(first.Data), Equals, fmt.Sprint(now+60))
+		c.Expect(string(second.Data), Equals, fmt.Sprint(now+30))
+
+		scheduled, _ := redis.Int(conn.Do("zcard", "prod:"+config.scheduledJobsQueue))
+		c.Expect(scheduled, Equals, 3)
+	})
+
+	c.Specify("enqueues a message when it's due rather than on the next poll", func() {
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		w := mkWorkers(config)
+		poller := newScheduled(config, config.retryQueue, config.scheduledJobsQueue)
+		poller.start()
+		defer poller.quit()
+
+		// Let the poller subscribe and go to sleep.
+		time.Sleep(100 * time.Millisecond)
+
+		w.EnqueueIn("wakequeue", "Add", 0.2, []int{1, 2})
+
+		time.Sleep(500 * time.Millisecond)
+
+		queued, _ := redis.Int(conn.Do("llen", "prod:queue:wakequeue"))
+		c.Expect(queued, Equals, 1)
+	})
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 )
 
 type stats struct {
@@ -23,20 +24,24 @@ func Stats(workers *Workers, w http.ResponseWriter, req *http.Request) {
 	enqueued := make(map[string]string)
 
 	for _, m := range workers.managers {
-		queue := m.queueName()
-		jobs[queue] = make([]*map[string]interface{}, 0)
-		enqueued[queue] = ""
+		for _, queue := range m.queueNames() {
+			jobs[queue] = make([]*map[string]interface{}, 0)
+			enqueued[queue] = ""
+		}
+		m.workersM.Lock()
 		for _, worker := range m.workers {
-			message := worker.currentMsg
-			startedAt := worker.startedAt
+			message := worker.current()
+			startedAt := atomic.LoadInt64(&worker.startedAt)
 
 			if message != nil && startedAt > 0 {
+				queue := m.queueNameOf(message)
 				jobs[queue] = append(jobs[queue], &map[string]interface{}{
 					"message":    message,
 					"started_at": startedAt,
 				})
 			}
 		}
+		m.workersM.Unlock()
 	}
 
 	stats := stats{
@@ -0,0 +1,113 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrJobTimeout is returned (wrapped) for a job that ran past its timeout.
+var ErrJobTimeout = errors.New("job timed out")
+
+// timeoutFor returns how long message may run: the timeout it was enqueued
+// with, or else the queue's default. Zero means no limit.
+func (m *manager) timeoutFor(message *Msg) time.Duration {
+	if seconds, err := message.Get("timeout").Float64(); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	return m.options.Timeout
+}
+
+// jobExit tells middlewares when the job really returned, which is later
+// than the chain when it timed out and was left running in the background.
+type jobExit struct {
+	sync.Mutex
+	// exited is closed once a job left running returns, nil otherwise.
+	exited chan bool
+}
+
+type jobExitKey struct{}
+
+// withJobExit returns ctx with a jobExit, reusing the one an outer middleware
+// made.
+func withJobExit(ctx context.Context) (context.Context, *jobExit) {
+	if exit, ok := ctx.Value(jobExitKey{}).(*jobExit); ok {
+		return ctx, exit
+	}
+
+	exit := &jobExit{}
+	return context.WithValue(ctx, jobExitKey{}, exit), exit
+}
+
+// after calls f once the job has returned: now, unless it was left running.
+func (e *jobExit) after(f func()) {
+	e.Lock()
+	exited := e.exited
+	e.Unlock()
+
+	if exited == nil {
+		f()
+		return
+	}
+
+	go (func() {
+		<-exited
+		f()
+	})()
+}
+
+func (e *jobExit) detach(exited chan bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.exited = exited
+}
+
+// runWithTimeout runs the job with a context that expires after timeout. If
+// the job hasn't returned by then ErrJobTimeout is returned, also when the
+// context was cancelled earlier because we're shutting down.
+//
+// A job that timed out keeps running in its goroutine until it returns. Its
+// worker is freed and the lease of its message is no longer extended, so the
+// message may run again elsewhere while it does; only middlewares waiting
+// through jobExit, like the concurrency limit, hold on until it returns.
+func runWithTimeout(ctx context.Context, timeout time.Duration, message *Msg, job ContextJobFunc) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	exited := make(chan bool)
+
+	go (func() {
+		defer close(exited)
+		result <- callRecovering(ctx, message, job)
+	})()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+	}
+
+	if ctx.Err() != context.DeadlineExceeded {
+		// cancelled because we're shutting down, keep waiting for the job
+		// until the deadline
+		deadline, _ := ctx.Deadline()
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		select {
+		case err := <-result:
+			return err
+		case <-timer.C:
+		}
+	}
+
+	if exit, ok := ctx.Value(jobExitKey{}).(*jobExit); ok {
+		exit.detach(exited)
+	}
+	return fmt.Errorf("%w after %v", ErrJobTimeout, timeout)
+}
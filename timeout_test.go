@@ -0,0 +1,112 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func TimeoutSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+
+	c.Specify("timeoutFor", func() {
+		manager := newManager(config, "myqueue", nil, 1)
+		manager.options.Timeout = 30 * time.Second
+
+		c.Specify("uses the queue timeout", func() {
+			message, _ := NewMsg("{\"jid\":\"2309823\"}")
+			c.Expect(manager.timeoutFor(message), Equals, 30*time.Second)
+		})
+
+		c.Specify("prefers the message timeout", func() {
+			message, _ := NewMsg("{\"jid\":\"2309823\",\"timeout\":1.5}")
+			c.Expect(manager.timeoutFor(message), Equals, 1500*time.Millisecond)
+		})
+	})
+
+	c.Specify("runWithTimeout", func() {
+		message, _ := NewMsg("{\"jid\":\"2309823\"}")
+
+		c.Specify("returns the job's result", func() {
+			err := runWithTimeout(context.Background(), time.Second, message, func(ctx context.Context, message *Msg) error {
+				return errors.New("failed")
+			})
+
+			c.Expect(err.Error(), Equals, "failed")
+		})
+
+		c.Specify("fails a job that runs too long", func() {
+			hang := make(chan bool)
+			defer close(hang)
+
+			err := runWithTimeout(context.Background(), 10*time.Millisecond, message, func(ctx context.Context, message *Msg) error {
+				<-hang
+				return nil
+			})
+
+			c.Expect(errors.Is(err, ErrJobTimeout), IsTrue)
+		})
+
+		c.Specify("cancels the job's context at the deadline", func() {
+			jobErr := make(chan error, 1)
+			runWithTimeout(context.Background(), 10*time.Millisecond, message, func(ctx context.Context, message *Msg) error {
+				<-ctx.Done()
+				jobErr <- ctx.Err()
+				return nil
+			})
+
+			c.Expect(<-jobErr, Equals, context.DeadlineExceeded)
+		})
+
+		c.Specify("still fails a job that runs too long once cancelled", func() {
+			hang := make(chan bool)
+			defer close(hang)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			err := runWithTimeout(ctx, 10*time.Millisecond, message, func(ctx context.Context, message *Msg) error {
+				<-hang
+				return nil
+			})
+
+			c.Expect(errors.Is(err, ErrJobTimeout), IsTrue)
+		})
+	})
+
+	c.Specify("timed out jobs are retried", func() {
+		hang := make(chan bool)
+		defer close(hang)
+
+		manager := newManager(config, "timeoutqueue", nil, 1)
+		manager.contextJob = func(ctx context.Context, message *Msg) error {
+			<-hang
+			return nil
+		}
+
+		worker := newWorker(manager)
+		messages := make(chan *Msg)
+		message, _ := NewMsg("{\"jid\":\"2309823\",\"retry\":true,\"timeout\":0.01}")
+
+		go worker.work(messages)
+		messages <- message
+
+		c.Expect(<-manager.confirm, Equals, message)
+
+		worker.quit()
+
+		conn := config.Pool.Get()
+		defer conn.Close()
+
+		retries, _ := redis.Strings(conn.Do("zrange", "prod:"+config.retryQueue, 0, 1))
+		c.Expect(len(retries), Equals, 1)
+
+		retried, _ := NewMsg(retries[0])
+		errorMessage, _ := retried.Get("error_message").String()
+		c.Expect(errorMessage, Equals, "job timed out after 10ms")
+	})
+}
@@ -0,0 +1,138 @@
+package workers
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// UniqueMode decides when the lock of a unique job is released, letting an
+// identical job be enqueued again.
+type UniqueMode string
+
+const (
+	// UniqueUntilExecuting releases the lock when the job starts running.
+	UniqueUntilExecuting UniqueMode = "until_executing"
+	// UniqueUntilExecuted releases the lock when the job succeeds or dies.
+	UniqueUntilExecuted UniqueMode = "until_executed"
+	// UniqueUntilExpired keeps the lock for UniqueFor whatever happens.
+	UniqueUntilExpired UniqueMode = "until_expired"
+)
+
+// How long the lock of a unique job is kept when UniqueFor isn't set, in
+// seconds.
+const defaultUniqueFor = 60 * 60
+
+// Locks a unique job. Returns the JID of the job holding the lock, or false
+// if the lock was free and ARGV[1] now holds it.
+//
+// KEYS[1]: the lock
+// ARGV[1]: the JID of the job
+// ARGV[2]: how long to keep the lock, in milliseconds
+var uniqueLockScript = redis.NewScript(1, `
+if redis.call('set', KEYS[1], ARGV[1], 'nx', 'px', ARGV[2]) then
+	return false
+end
+return redis.call('get', KEYS[1])
+`)
+
+// Releases the lock of a unique job if that job still holds it.
+//
+// KEYS[1]: the lock
+// ARGV[1]: the JID of the job
+var uniqueUnlockScript = redis.NewScript(1, `
+if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('del', KEYS[1])
+end
+return 0
+`)
+
+// uniqueDigest identifies identical jobs: by key if one is given, else by
+// queue, class and args.
+func uniqueDigest(queue, class string, args interface{}, key string) (string, error) {
+	if key == "" {
+		argsJson, err := json.Marshal(args)
+		if err != nil {
+			return "", err
+		}
+		key = queue + "\n" + class + "\n" + string(argsJson)
+	}
+
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key))), nil
+}
+
+func uniqueLockKey(config *config, digest string) string {
+	return config.NamespacedKey("unique", digest)
+}
+
+// lockUnique takes the lock of a unique job for ttl seconds. When an
+// identical job holds it, that job's JID is returned instead.
+func lockUnique(config *config, digest, jid string, ttl float64) (string, error) {
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	holder, err := redis.String(uniqueLockScript.Do(conn, uniqueLockKey(config, digest), jid, int64(math.Ceil(ttl*1000))))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return holder, err
+}
+
+// releaseUnique releases the lock held by message, if it's a unique job.
+func releaseUnique(config *config, message *Msg) {
+	if digest, err := message.Get("unique_digest").String(); err == nil && digest != "" {
+		unlockUnique(config, digest, message.Jid())
+	}
+}
+
+// unlockUnique releases the lock of digest if the job jid still holds it.
+func unlockUnique(config *config, digest, jid string) {
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	if _, err := uniqueUnlockScript.Do(conn, uniqueLockKey(config, digest), jid); err != nil {
+		Logger.Println("ERR: couldn't release unique lock of", jid, ":", err)
+	}
+}
+
+// MiddlewareUnique releases the lock of unique jobs, according to their
+// mode. Jobs that die release their lock when they're moved to the dead set.
+type MiddlewareUnique struct {
+	config *config
+}
+
+func (u *MiddlewareUnique) Call(queue string, message *Msg, next func() error) error {
+	return u.CallContext(context.Background(), queue, message, func(context.Context) error {
+		return next()
+	})
+}
+
+func (u *MiddlewareUnique) CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+	mode, _ := message.Get("unique").String()
+
+	if UniqueMode(mode) == UniqueUntilExecuting {
+		releaseUnique(u.config, message)
+	}
+
+	err := next(ctx)
+
+	if UniqueMode(mode) == UniqueUntilExecuted && (err == nil || !willRetry(message, u.config.retryPolicyFor(ctx, message), err)) {
+		releaseUnique(u.config, message)
+	}
+
+	return err
+}
+
+// retriable is false for errors that drop the job instead of retrying it.
+func retriable(err error) bool {
+	var discard *DiscardError
+	var nonRetryable *NonRetryableError
+
+	return !errors.As(err, &discard) && !errors.As(err, &nonRetryable)
+}
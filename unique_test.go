@@ -0,0 +1,173 @@
+package workers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func UniqueSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	w := mkWorkers(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	unique := EnqueueOptions{Unique: UniqueUntilExecuted}
+
+	queued := func(queue string) int {
+		count, _ := redis.Int(conn.Do("llen", "prod:queue:"+queue))
+		return count
+	}
+
+	c.Specify("EnqueueWithOptions", func() {
+		c.Specify("returns the JID of an identical job instead of enqueuing it", func() {
+			jid, err := w.EnqueueWithOptions("uniquequeue", "Sync", []int{1}, unique)
+			c.Expect(err, IsNil)
+
+			duplicate, err := w.EnqueueWithOptions("uniquequeue", "Sync", []int{1}, unique)
+			c.Expect(err, IsNil)
+			c.Expect(duplicate, Equals, jid)
+
+			c.Expect(queued("uniquequeue"), Equals, 1)
+		})
+
+		c.Specify("enqueues jobs with other args", func() {
+			jid, _ := w.EnqueueWithOptions("uniquequeue", "Sync", []int{1}, unique)
+			other, _ := w.EnqueueWithOptions("uniquequeue", "Sync", []int{2}, unique)
+
+			c.Expect(other, Not(Equals), jid)
+			c.Expect(queued("uniquequeue"), Equals, 2)
+		})
+
+		c.Specify("uses the unique key instead of args", func() {
+			opts := EnqueueOptions{Unique: UniqueUntilExecuted, UniqueKey: "account-1"}
+
+			jid, _ := w.EnqueueWithOptions("uniquequeue", "Sync", []int{1}, opts)
+			duplicate, _ := w.EnqueueWithOptions("uniquequeue", "Sync", []int{2}, opts)
+
+			c.Expect(duplicate, Equals, jid)
+			c.Expect(queued("uniquequeue"), Equals, 1)
+		})
+
+		c.Specify("locks for UniqueFor", func() {
+			w.EnqueueWithOptions("uniquequeue", "Sync", []int{1}, EnqueueOptions{Unique: UniqueUntilExpired, UniqueFor: 120})
+
+			digest, _ := uniqueDigest("uniquequeue", "Sync", []int{1}, "")
+			ttl, _ := redis.Int(conn.Do("pttl", "prod:unique:"+digest))
+			c.Expect(float64(ttl), IsWithin(1000), 120000.0)
+		})
+
+		c.Specify("locks scheduled jobs until UniqueFor after they're due", func() {
+			opts := EnqueueOptions{Unique: UniqueUntilExpired, UniqueFor: 120, At: nowToSecondsWithNanoPrecision() + 60}
+			w.EnqueueWithOptions("uniquequeue", "Sync", []int{1}, opts)
+
+			digest, _ := uniqueDigest("uniquequeue", "Sync", []int{1}, "")
+			ttl, _ := redis.Int(conn.Do("pttl", "prod:unique:"+digest))
+			c.Expect(float64(ttl), IsWithin(1000), 180000.0)
+		})
+	})
+
+	c.Specify("MiddlewareUnique", func() {
+		wares := NewMiddleware(&MiddlewareUnique{config})
+
+		enqueued := func(mode UniqueMode) *Msg {
+			w.EnqueueWithOptions("uniquequeue", "Sync", []int{1}, EnqueueOptions{Unique: mode, Retry: true})
+			json, _ := redis.String(conn.Do("rpop", "prod:queue:uniquequeue"))
+			message, _ := NewMsg(json)
+			return message
+		}
+
+		locked := func() bool {
+			digest, _ := uniqueDigest("uniquequeue", "Sync", []int{1}, "")
+			exists, _ := redis.Bool(conn.Do("exists", "prod:unique:"+digest))
+			return exists
+		}
+
+		c.Specify("releases until executing jobs when they start", func() {
+			message := enqueued(UniqueUntilExecuting)
+
+			wares.callContext(context.Background(), "uniquequeue", message, func(context.Context) error {
+				c.Expect(locked(), IsFalse)
+				return errors.New("failed")
+			})
+		})
+
+		c.Specify("releases until executed jobs when they succeed", func() {
+			message := enqueued(UniqueUntilExecuted)
+
+			wares.callContext(context.Background(), "uniquequeue", message, func(context.Context) error {
+				c.Expect(locked(), IsTrue)
+				return nil
+			})
+
+			c.Expect(locked(), IsFalse)
+		})
+
+		c.Specify("keeps until executed jobs locked while they're retried", func() {
+			message := enqueued(UniqueUntilExecuted)
+
+			wares.callContext(context.Background(), "uniquequeue", message, func(context.Context) error {
+				return errors.New("failed")
+			})
+
+			c.Expect(locked(), IsTrue)
+		})
+
+		c.Specify("releases until executed jobs that fail without retries", func() {
+			w.EnqueueWithOptions("uniquequeue", "Sync", []int{1}, EnqueueOptions{Unique: UniqueUntilExecuted})
+			json, _ := redis.String(conn.Do("rpop", "prod:queue:uniquequeue"))
+			message, _ := NewMsg(json)
+
+			wares.callContext(context.Background(), "uniquequeue", message, func(context.Context) error {
+				return errors.New("failed")
+			})
+
+			c.Expect(locked(), IsFalse)
+		})
+
+		c.Specify("releases until executed jobs that are discarded", func() {
+			message := enqueued(UniqueUntilExecuted)
+
+			wares.callContext(context.Background(), "uniquequeue", message, func(context.Context) error {
+				return Discard(errors.New("stale"))
+			})
+
+			c.Expect(locked(), IsFalse)
+		})
+
+		c.Specify("releases until executed jobs that die", func() {
+			message := enqueued(UniqueUntilExecuted)
+
+			c.Expect(addToDeadSet(config, "uniquequeue", message, errors.New("failed")), IsNil)
+
+			c.Expect(locked(), IsFalse)
+		})
+
+		c.Specify("keeps until expired jobs locked", func() {
+			message := enqueued(UniqueUntilExpired)
+
+			wares.callContext(context.Background(), "uniquequeue", message, func(context.Context) error {
+				return nil
+			})
+
+			c.Expect(locked(), IsTrue)
+		})
+
+		c.Specify("doesn't release a lock taken by another job", func() {
+			message := enqueued(UniqueUntilExecuted)
+
+			digest, _ := uniqueDigest("uniquequeue", "Sync", []int{1}, "")
+			conn.Do("set", "prod:unique:"+digest, "another")
+
+			wares.callContext(context.Background(), "uniquequeue", message, func(context.Context) error {
+				return nil
+			})
+
+			c.Expect(locked(), IsTrue)
+		})
+	})
+}
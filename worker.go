@@ -1,15 +1,20 @@
 package workers
 
 import (
+	"context"
+	"strconv"
 	"sync/atomic"
 	"time"
 )
 
+var workerIds int64
+
 type worker struct {
+	id         string
 	manager    *manager
 	stop       chan bool
 	exit       chan bool
-	currentMsg *Msg
+	currentMsg atomic.Value
 	startedAt  int64
 }
 
@@ -27,14 +32,14 @@ func (w *worker) work(messages chan *Msg) {
 		select {
 		case message := <-messages:
 			atomic.StoreInt64(&w.startedAt, time.Now().UTC().Unix())
-			w.currentMsg = message
+			w.currentMsg.Store(message)
 
 			if err := w.process(message); err == nil {
 				w.manager.confirm <- message
 			}
 
 			atomic.StoreInt64(&w.startedAt, 0)
-			w.currentMsg = nil
+			w.currentMsg.Store((*Msg)(nil))
 
 			// Attempt to tell fetcher we're finished.
 			// Can be used when the fetcher has slept due
@@ -55,23 +60,44 @@ func (w *worker) work(messages chan *Msg) {
 }
 
 func (w *worker) process(message *Msg) (err error) {
+	// Handler panics are turned into errors inside the middleware chain, this
+	// catches panics from the middlewares themselves.
 	defer func() {
-		recoveredErr := recover()
-
-		if recoveredErr != nil {
-			Logger.Printf("recovered panic with error '%s' but discarding", recoveredErr)
+		if recovered := recover(); recovered != nil {
+			err = newPanicError(recovered)
 		}
 	}()
 
-	return w.manager.mids.call(w.manager.queueName(), message, func() error {
-		return w.manager.job(message)
+	if holder, ok := w.manager.fetch.(leaseHolder); ok {
+		defer holder.holdLease(message)()
+	}
+
+	queue := w.manager.queueNameOf(message)
+	ctx := newJobContext(w.manager.ctx, queue, message)
+	ctx = withQueueRetryPolicy(ctx, w.manager.options.RetryPolicy)
+	ctx = withQueueRateLimiter(ctx, w.manager.options.RateLimiter)
+
+	return w.manager.mids.callContext(ctx, queue, message, func(ctx context.Context) error {
+		if timeout := w.manager.timeoutFor(message); timeout > 0 {
+			return runWithTimeout(ctx, timeout, message, w.manager.contextJob)
+		}
+
+		return callRecovering(ctx, message, w.manager.contextJob)
 	})
 }
 
+// current returns the message being worked on, or nil. It's read by the
+// heartbeat and stats while the worker writes it.
+func (w *worker) current() *Msg {
+	message, _ := w.currentMsg.Load().(*Msg)
+	return message
+}
+
 func (w *worker) processing() bool {
 	return atomic.LoadInt64(&w.startedAt) > 0
 }
 
 func newWorker(m *manager) *worker {
-	return &worker{m, make(chan bool), make(chan bool), nil, 0}
+	id := strconv.FormatInt(atomic.AddInt64(&workerIds, 1), 36)
+	return &worker{id, m, make(chan bool), make(chan bool), atomic.Value{}, 0}
 }
@@ -119,15 +119,49 @@ func WorkerSpec(c gospec.Context) {
 			worker.manager.mids = defaultMiddlewares
 		})
 
-		c.Specify("recovers and cancels if job panics", func() {
+		c.Specify("recovers and fails if job panics", func() {
 			var panicJob = (func(message *Msg) error {
 				panic("AHHHH")
 				return nil
 			})
 
 			manager := newManager(config, "myqueue", panicJob, 1)
+			manager.mids = NewMiddleware()
 			worker := newWorker(manager)
 
+			err := worker.process(message)
+
+			var panicErr *PanicError
+			c.Expect(errors.As(err, &panicErr), IsTrue)
+			c.Expect(panicErr.Value, Equals, "AHHHH")
+			c.Expect(len(panicErr.Stack) > 0, IsTrue)
+		})
+
+		c.Specify("drops jobs that panic without retries", func() {
+			var panicJob = (func(message *Msg) error {
+				panic("AHHHH")
+			})
+
+			manager := newManager(config, "myqueue", panicJob, 1)
+			worker := newWorker(manager)
+
+			go worker.work(messages)
+			messages <- message
+
+			c.Expect(confirm(manager), Equals, message)
+
+			worker.quit()
+		})
+
+		c.Specify("retries if job panics", func() {
+			var panicJob = (func(message *Msg) error {
+				panic("AHHHH")
+			})
+
+			manager := newManager(config, "myqueue", panicJob, 1)
+			worker := newWorker(manager)
+			message, _ := NewMsg("{\"jid\":\"2309823\",\"retry\":true,\"args\":[]}")
+
 			go worker.work(messages)
 			messages <- message
 
@@ -149,6 +183,8 @@ func BenchmarkWorkMockedRedis(b *testing.B) {
 			switch commandName {
 			case "brpoplpush":
 				return <-queue, nil
+			case "sismember":
+				return int64(0), nil
 			case "lrem":
 				acknowledged <- args[2].(string)
 			case "zrangebyscore":
@@ -6,7 +6,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -17,11 +19,18 @@ type Workers struct {
 	config      *config
 	managers    map[string]*manager
 	schedule    *scheduled
+	heartbeat   *heartbeat
+	reaper      *reaper
+	periodic    *periodic
+	cancels     *cancelListener
 	control     map[string]chan string
 	access      sync.Mutex
 	started     bool
+	abandoned   chan bool
 	beforeStart []func()
 	duringDrain []func()
+
+	periodicJobs []*periodicJob
 }
 
 // ensure that Workers struct fulfils GoWorkers interface
@@ -39,8 +48,15 @@ func NewWorkers(config *config) *Workers {
 
 func newDefaultMiddlewares(config *config) *Middlewares {
 	return NewMiddleware(
+		&MiddlewareConcurrency{config},
+		&MiddlewareRateLimit{config},
 		&MiddlewareRetry{config},
 		&MiddlewareStats{config},
+		&MiddlewareUnique{config},
+		&MiddlewareBatch{config},
+		&MiddlewareWorkflow{config},
+		&MiddlewareStatus{config},
+		&MiddlewareCancel{config},
 	)
 }
 
@@ -55,6 +71,102 @@ func (w *Workers) Process(queue string, job jobFunc, concurrency int, mids ...Ac
 	w.managers[queue] = newManager(w.config, queue, job, concurrency, mids...)
 }
 
+type ProcessOptions struct {
+	// Timeout is how long a job may run before it's failed, unless it was
+	// enqueued with its own timeout. Zero means no limit.
+	Timeout time.Duration
+
+	// RetryPolicy is used for failed jobs of this queue, unless their class
+	// has a policy set with SetRetryPolicy.
+	RetryPolicy RetryPolicy
+
+	// RateLimiter limits how often jobs of this queue run, across every
+	// process. Jobs over the limit are rescheduled. Its Name defaults to
+	// "queue:" and the queue.
+	RateLimiter RateLimiter
+}
+
+// ProcessWithOptions is like ProcessWithContext with per-queue options.
+func (w *Workers) ProcessWithOptions(queue string, job ContextJobFunc, concurrency int, opts ProcessOptions, mids ...Action) error {
+	if opts.RateLimiter != nil {
+		limiter, err := opts.RateLimiter.withDefaults("queue:" + queue)
+		if err != nil {
+			return err
+		}
+		opts.RateLimiter = limiter
+	}
+
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	m := newManager(w.config, queue, nil, concurrency, mids...)
+	m.contextJob = job
+	m.options = opts
+	w.managers[queue] = m
+	return nil
+}
+
+// ProcessWithContext is like Process for a handler that takes a context.
+func (w *Workers) ProcessWithContext(queue string, job ContextJobFunc, concurrency int, mids ...Action) {
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	m := newManager(w.config, queue, nil, concurrency, mids...)
+	m.contextJob = job
+	w.managers[queue] = m
+}
+
+// ProcessQueues runs one pool of concurrency workers over several queues.
+// With StrictOrder a queue is only fetched from when every queue before it
+// is empty; with WeightedOrder queues are picked at random in proportion to
+// their weight. The pool is registered under the queue names joined by ","
+// (e.g. "critical,default"), which is the name to pass to SetConcurrency.
+func (w *Workers) ProcessQueues(queues []WeightedQueue, order QueueOrder, job jobFunc, concurrency int, mids ...Action) {
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	names := make([]string, len(queues))
+	for i, queue := range queues {
+		names[i] = queue.Name
+	}
+
+	w.managers[strings.Join(names, ",")] = newMultiQueueManager(w.config, queues, order, job, concurrency, mids...)
+}
+
+// ProcessQueuesWithContext is like ProcessQueues for a handler that takes a
+// context.
+func (w *Workers) ProcessQueuesWithContext(queues []WeightedQueue, order QueueOrder, job ContextJobFunc, concurrency int, mids ...Action) {
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	names := make([]string, len(queues))
+	for i, queue := range queues {
+		names[i] = queue.Name
+	}
+
+	m := newMultiQueueManager(w.config, queues, order, nil, concurrency, mids...)
+	m.contextJob = job
+	w.managers[strings.Join(names, ",")] = m
+}
+
+func (w *Workers) SetConcurrency(queue string, concurrency int) error {
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	if concurrency < 1 {
+		return errors.New("Concurrency must be at least 1")
+	}
+
+	manager, ok := w.managers[queue]
+	if !ok {
+		return fmt.Errorf("No manager is processing queue %s", queue)
+	}
+
+	manager.setConcurrency(concurrency)
+
+	return nil
+}
+
 func (w *Workers) Run() {
 	w.Start()
 	go w.handleSignals()
@@ -82,9 +194,15 @@ func (w *Workers) Start() {
 		return
 	}
 
+	w.abandoned = make(chan bool)
+
 	runHooks(w.beforeStart)
 	w.startSchedule()
+	w.startCancelListener()
 	w.startManagers()
+	w.startHeartbeat()
+	w.startReaper()
+	w.startPeriodic()
 
 	w.started = true
 }
@@ -99,8 +217,18 @@ func (w *Workers) Quit() {
 
 	w.quitManagers()
 	w.quitSchedule()
+	w.quitReaper()
+	w.quitPeriodic()
 	runHooks(w.duringDrain)
+
+	if w.config.ShutdownTimeout > 0 {
+		timer := time.AfterFunc(time.Duration(w.config.ShutdownTimeout)*time.Second, w.abandonManagers(w.abandoned))
+		defer timer.Stop()
+	}
+
 	w.WaitForExit()
+	w.quitCancelListener()
+	w.quitHeartbeat()
 
 	w.started = false
 }
@@ -133,6 +261,59 @@ func (w *Workers) quitSchedule() {
 	}
 }
 
+func (w *Workers) startHeartbeat() {
+	managers := make([]*manager, 0, len(w.managers))
+	for _, manager := range w.managers {
+		managers = append(managers, manager)
+	}
+
+	w.heartbeat = newHeartbeat(w.config, managers)
+	w.heartbeat.start()
+}
+
+func (w *Workers) quitHeartbeat() {
+	if w.heartbeat != nil {
+		w.heartbeat.quit()
+		w.heartbeat = nil
+	}
+}
+
+func (w *Workers) startReaper() {
+	w.reaper = newReaper(w.config)
+	w.reaper.start()
+}
+
+func (w *Workers) quitReaper() {
+	if w.reaper != nil {
+		w.reaper.quit()
+		w.reaper = nil
+	}
+}
+
+func (w *Workers) startCancelListener() {
+	w.cancels = newCancelListener(w.config)
+	w.cancels.start()
+}
+
+func (w *Workers) quitCancelListener() {
+	if w.cancels != nil {
+		w.cancels.quit()
+		w.cancels = nil
+	}
+}
+
+func (w *Workers) startPeriodic() {
+	w.periodic = newPeriodic(w, w.periodicJobs)
+	w.periodic.start()
+}
+
+func (w *Workers) quitPeriodic() {
+	if w.periodic != nil {
+		w.periodic.quit()
+		w.periodic = nil
+	}
+}
+
 func (w *Workers) startManagers() {
 	for _, manager := range w.managers {
 		manager.start()
@@ -140,13 +321,49 @@ func (w *Workers) startManagers() {
 }
 
 func (w *Workers) quitManagers() {
+	// Every fetcher is stopped before the shutdown timeout starts, so nothing
+	// is fetched again once in progress messages are requeued.
+	var prepared sync.WaitGroup
+	for _, m := range w.managers {
+		prepared.Add(1)
+		go (func(m *manager) {
+			m.prepareForQuit()
+			prepared.Done()
+		})(m)
+	}
+	prepared.Wait()
+
 	for _, m := range w.managers {
 		go (func(m *manager) { m.quit() })(m)
 	}
 }
 
+// abandonManagers returns a func that puts messages still in progress back
+// on their queues and stops WaitForExit from waiting for them.
+func (w *Workers) abandonManagers(abandoned chan bool) func() {
+	return func() {
+		Logger.Println("shutdown timeout expired, requeueing in progress jobs.")
+
+		for _, manager := range w.managers {
+			manager.abandon()
+		}
+
+		close(abandoned)
+	}
+}
+
 func (w *Workers) WaitForExit() {
-	for _, manager := range w.managers {
-		manager.Wait()
+	exited := make(chan bool)
+
+	go (func() {
+		for _, manager := range w.managers {
+			manager.Wait()
+		}
+		close(exited)
+	})()
+
+	select {
+	case <-exited:
+	case <-w.abandoned:
 	}
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/customerio/gospec"
 	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
 )
 
 var called chan bool
@@ -14,6 +15,15 @@ func myJob(message *Msg) error {
 	return nil
 }
 
+type queueRecorder struct {
+	queues chan string
+}
+
+func (r *queueRecorder) Call(queue string, message *Msg, next func() error) error {
+	r.queues <- queue
+	return next()
+}
+
 func WorkersSpec(c gospec.Context) {
 	c.Specify("Workers", func() {
 		config := mkDefaultConfig()
@@ -32,6 +42,72 @@ func WorkersSpec(c gospec.Context) {
 			w.Quit()
 		})
 
+		c.Specify("processes several queues with one pool", func() {
+			called = make(chan bool)
+			mid := &queueRecorder{queues: make(chan string, 2)}
+
+			w.ProcessQueues([]WeightedQueue{{"high", 1}, {"low", 1}}, StrictOrder, myJob, 1, mid)
+
+			w.Start()
+
+			w.Enqueue("low", "Add", []int{1, 2})
+			<-called
+			c.Expect(<-mid.queues, Equals, "prod:low")
+
+			w.Enqueue("high", "Add", []int{1, 2})
+			<-called
+			c.Expect(<-mid.queues, Equals, "prod:high")
+
+			w.Quit()
+		})
+
+		c.Specify("requeues running jobs when the shutdown timeout expires", func() {
+			config.ShutdownTimeout = 1
+			defer (func() { config.ShutdownTimeout = 0 })()
+
+			started := make(chan bool)
+			hang := make(chan bool)
+			defer close(hang)
+
+			w.Process("slowqueue", func(message *Msg) error {
+				started <- true
+				<-hang
+				return nil
+			}, 1)
+
+			w.Start()
+
+			w.Enqueue("slowqueue", "Add", []int{1, 2})
+			<-started
+
+			w.Quit()
+
+			conn := config.Pool.Get()
+			defer conn.Close()
+
+			queued, _ := redis.Int(conn.Do("llen", "prod:queue:slowqueue"))
+			inprogress, _ := redis.Int(conn.Do("llen", "prod:queue:slowqueue:1:inprogress"))
+			c.Expect(queued, Equals, 1)
+			c.Expect(inprogress, Equals, 0)
+		})
+
+		c.Specify("changes concurrency of a processed queue", func() {
+			w.Process("myqueue", myJob, 10)
+
+			c.Expect(w.SetConcurrency("myqueue", 20), IsNil)
+			c.Expect(w.managers["myqueue"].concurrency, Equals, 20)
+		})
+
+		c.Specify("refuses to change concurrency of an unknown queue", func() {
+			c.Expect(w.SetConcurrency("unknown", 20), Not(IsNil))
+		})
+
+		c.Specify("refuses concurrency below one", func() {
+			w.Process("myqueue", myJob, 10)
+
+			c.Expect(w.SetConcurrency("myqueue", 0), Not(IsNil))
+		})
+
 		// TODO make this test more deterministic, randomly locks up in travis.
 		//c.Specify("allows starting and stopping multiple times", func() {
 		//	called = make(chan bool)
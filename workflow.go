@@ -0,0 +1,391 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// How long a workflow is kept after it last changed, in seconds.
+const workflowTTL = 30 * 24 * 60 * 60
+
+var (
+	ErrWorkflowNotFound = errors.New("workflow not found")
+	ErrNoUpstreamResult = errors.New("no result from upstream node")
+)
+
+// WorkflowState is how far a workflow has got.
+type WorkflowState string
+
+const (
+	WorkflowRunning   WorkflowState = "running"
+	WorkflowSucceeded WorkflowState = "succeeded"
+	// WorkflowFailed is set once a node fails for good, i.e. it won't be
+	// retried. No more nodes are enqueued after that.
+	WorkflowFailed WorkflowState = "failed"
+)
+
+// Workflow runs jobs in dependency order: each node is enqueued once every
+// node it comes after has succeeded. Nodes may pass results downstream with
+// SetResult and UpstreamResult.
+type Workflow struct {
+	ID string
+
+	workers     *Workers
+	description string
+	nodes       []*WorkflowNode
+	byName      map[string]*WorkflowNode
+}
+
+// WorkflowNode is a job of a workflow.
+type WorkflowNode struct {
+	Name  string
+	Queue string
+	Class string
+	Args  interface{}
+	// After lists the nodes that must succeed before this one runs. They must
+	// have been added first, which keeps workflows free of cycles.
+	After []string
+	// Options are used to enqueue the job, except At, Unique and BatchID.
+	Options EnqueueOptions
+}
+
+// WorkflowStatus describes a workflow and the results of its nodes.
+type WorkflowStatus struct {
+	ID          string
+	Description string
+	State       WorkflowState
+	Total       int
+	// Pending is how many nodes haven't succeeded yet.
+	Pending    int
+	FailedNode string
+	Results    map[string]json.RawMessage
+	CreatedAt  time.Time
+	// FinishedAt is when the workflow succeeded or failed, zero until then.
+	FinishedAt time.Time
+}
+
+// workflowMessage is the message of a node.
+type workflowMessage struct {
+	EnqueueData
+	Workflow string   `json:"workflow"`
+	Node     string   `json:"node"`
+	After    []string `json:"after,omitempty"`
+}
+
+// Records that a node succeeded, enqueuing the nodes whose dependencies are
+// now met, or that it failed, failing the workflow.
+//
+// KEYS[1]: the workflow
+// KEYS[2]: the messages of the nodes
+// KEYS[3]: the queues of the nodes
+// KEYS[4]: how many dependencies of each node haven't succeeded
+// KEYS[5]: the dependants of each node, separated by newlines
+// KEYS[6]: the results of the nodes
+// KEYS[7]: the set of queues
+// ARGV[1]: the node
+// ARGV[2]: "success" or "failure"
+// ARGV[3]: the result of the node, as JSON
+// ARGV[4]: the current time
+// ARGV[5]: how long to keep the workflow, in seconds
+// ARGV[6]: the prefix of queue keys
+var workflowNodeDoneScript = redis.NewScript(7, `
+if redis.call('hget', KEYS[1], 'state') ~= 'running' then
+	return 0
+end
+if ARGV[2] == 'failure' then
+	redis.call('hmset', KEYS[1], 'state', 'failed', 'failed_node', ARGV[1], 'finished_at', ARGV[4])
+elseif redis.call('hsetnx', KEYS[6], ARGV[1], ARGV[3]) == 1 then
+	local dependants = redis.call('hget', KEYS[5], ARGV[1]) or ''
+	for node in string.gmatch(dependants, '[^\n]+') do
+		if redis.call('hincrby', KEYS[4], node, -1) == 0 then
+			local queue = redis.call('hget', KEYS[3], node)
+			redis.call('sadd', KEYS[7], queue)
+			redis.call('rpush', ARGV[6] .. queue, redis.call('hget', KEYS[2], node))
+		end
+	end
+	if redis.call('hincrby', KEYS[1], 'pending', -1) == 0 then
+		redis.call('hmset', KEYS[1], 'state', 'succeeded', 'finished_at', ARGV[4])
+	end
+end
+for i = 1, 6 do
+	redis.call('expire', KEYS[i], ARGV[5])
+end
+return 1
+`)
+
+func workflowKey(config *config, id string, parts ...string) string {
+	return config.NamespacedKey(append([]string{"workflow", id}, parts...)...)
+}
+
+// workflowKeys are the keys of workflowNodeDoneScript.
+func workflowKeys(config *config, id string) []interface{} {
+	return []interface{}{
+		workflowKey(config, id),
+		workflowKey(config, id, "nodes"),
+		workflowKey(config, id, "queues"),
+		workflowKey(config, id, "deps"),
+		workflowKey(config, id, "dependants"),
+		workflowKey(config, id, "results"),
+		config.NamespacedKey("queues"),
+	}
+}
+
+// NewWorkflow creates an empty workflow. Nothing is stored until it's
+// started.
+func (w *Workers) NewWorkflow(description string) *Workflow {
+	return &Workflow{generateJid(), w, description, nil, make(map[string]*WorkflowNode)}
+}
+
+// Add adds a node to the workflow.
+func (f *Workflow) Add(node WorkflowNode) error {
+	if node.Name == "" || strings.Contains(node.Name, "\n") {
+		return fmt.Errorf("workflow: invalid node name %q", node.Name)
+	}
+	if _, ok := f.byName[node.Name]; ok {
+		return fmt.Errorf("workflow: node %q added twice", node.Name)
+	}
+	for _, upstream := range node.After {
+		if _, ok := f.byName[upstream]; !ok {
+			return fmt.Errorf("workflow: node %q comes after unknown node %q", node.Name, upstream)
+		}
+	}
+
+	f.nodes = append(f.nodes, &node)
+	f.byName[node.Name] = &node
+
+	return nil
+}
+
+// Start stores the workflow and enqueues the nodes that don't come after
+// any other.
+func (f *Workflow) Start() error {
+	if len(f.nodes) == 0 {
+		return errors.New("workflow: no nodes to run")
+	}
+
+	config := f.workers.config
+	now := nowToSecondsWithNanoPrecision()
+
+	messages := redis.Args{}.Add(workflowKey(config, f.ID, "nodes"))
+	queues := redis.Args{}.Add(workflowKey(config, f.ID, "queues"))
+	deps := redis.Args{}.Add(workflowKey(config, f.ID, "deps"))
+	dependants := make(map[string][]string)
+	roots := make(map[*WorkflowNode][]byte)
+
+	for _, node := range f.nodes {
+		opts := node.Options
+		opts.At, opts.Unique, opts.BatchID = 0, "", ""
+
+		message, err := json.Marshal(workflowMessage{
+			EnqueueData{Queue: node.Queue, Class: node.Class, Args: node.Args, Jid: generateJid(), EnqueuedAt: now, EnqueueOptions: opts},
+			f.ID,
+			node.Name,
+			node.After,
+		})
+		if err != nil {
+			return err
+		}
+
+		messages = messages.Add(node.Name, message)
+		queues = queues.Add(node.Name, node.Queue)
+		deps = deps.Add(node.Name, len(node.After))
+
+		for _, upstream := range node.After {
+			dependants[upstream] = append(dependants[upstream], node.Name)
+		}
+
+		if len(node.After) == 0 {
+			roots[node] = message
+		}
+	}
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	conn.Send("multi")
+	conn.Send("hmset", workflowKey(config, f.ID),
+		"description", f.description,
+		"state", WorkflowRunning,
+		"total", len(f.nodes),
+		"pending", len(f.nodes),
+		"created_at", now,
+	)
+	conn.Send("hmset", messages...)
+	conn.Send("hmset", queues...)
+	conn.Send("hmset", deps...)
+	if len(dependants) > 0 {
+		args := redis.Args{}.Add(workflowKey(config, f.ID, "dependants"))
+		for upstream, nodes := range dependants {
+			args = args.Add(upstream, strings.Join(nodes, "\n"))
+		}
+		conn.Send("hmset", args...)
+	}
+	for _, key := range workflowKeys(config, f.ID)[:5] {
+		conn.Send("expire", key, workflowTTL)
+	}
+	for _, node := range f.nodes {
+		if message, ok := roots[node]; ok {
+			conn.Send("sadd", config.NamespacedKey("queues"), node.Queue)
+			conn.Send("rpush", config.NamespacedKey("queue", node.Queue), message)
+		}
+	}
+	_, err := conn.Do("exec")
+
+	return err
+}
+
+// WorkflowStatus returns the state of the workflow id.
+func (w *Workers) WorkflowStatus(id string) (*WorkflowStatus, error) {
+	conn := w.config.Pool.Get()
+	defer conn.Close()
+
+	conn.Send("hgetall", workflowKey(w.config, id))
+	conn.Send("hgetall", workflowKey(w.config, id, "results"))
+	conn.Flush()
+
+	workflow, err := redis.StringMap(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := redis.StringMap(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(workflow) == 0 {
+		return nil, ErrWorkflowNotFound
+	}
+
+	status := &WorkflowStatus{
+		ID:          id,
+		Description: workflow["description"],
+		State:       WorkflowState(workflow["state"]),
+		FailedNode:  workflow["failed_node"],
+		Results:     make(map[string]json.RawMessage, len(results)),
+	}
+	status.Total, _ = strconv.Atoi(workflow["total"])
+	status.Pending, _ = strconv.Atoi(workflow["pending"])
+	status.CreatedAt = parseTimestamp(workflow["created_at"])
+	status.FinishedAt = parseTimestamp(workflow["finished_at"])
+
+	for node, result := range results {
+		status.Results[node] = json.RawMessage(result)
+	}
+
+	return status, nil
+}
+
+type upstreamResultsKey struct{}
+
+// UpstreamResult decodes into v the result recorded with SetResult by node,
+// which the running workflow node comes after.
+func UpstreamResult(ctx context.Context, node string, v interface{}) error {
+	upstream, ok := ctx.Value(upstreamResultsKey{}).(map[string]json.RawMessage)
+	if !ok {
+		return ErrNoUpstreamResult
+	}
+
+	result, ok := upstream[node]
+	if !ok {
+		return ErrNoUpstreamResult
+	}
+
+	return json.Unmarshal(result, v)
+}
+
+// MiddlewareWorkflow gives workflow nodes the results of the nodes they
+// come after, and enqueues the nodes after them once they succeed. A node
+// that fails for good or is cancelled fails its workflow. Discarded nodes
+// count as succeeded.
+type MiddlewareWorkflow struct {
+	config *config
+}
+
+func (m *MiddlewareWorkflow) Call(queue string, message *Msg, next func() error) error {
+	return m.CallContext(context.Background(), queue, message, func(context.Context) error {
+		return next()
+	})
+}
+
+func (m *MiddlewareWorkflow) CallContext(ctx context.Context, queue string, message *Msg, next func(context.Context) error) error {
+	id, _ := message.Get("workflow").String()
+	if id == "" {
+		return next(ctx)
+	}
+
+	node, _ := message.Get("node").String()
+
+	upstream, err := m.upstreamResults(id, message)
+	if err != nil {
+		return err
+	}
+
+	ctx, result := withJobResult(ctx)
+	err = next(context.WithValue(ctx, upstreamResultsKey{}, upstream))
+
+	outcome := "success"
+	var discard *DiscardError
+	if err != nil && (!errors.As(err, &discard) || errors.Is(err, ErrJobCancelled)) {
+		if willRetry(message, m.config.retryPolicyFor(ctx, message), err) {
+			return err
+		}
+		outcome = "failure"
+	}
+
+	conn := m.config.Pool.Get()
+	defer conn.Close()
+
+	workflowNodeDone(m.config, conn, id, node, outcome, result.json())
+
+	return err
+}
+
+// workflowNodeDone records the outcome of node in the workflow id.
+func workflowNodeDone(config *config, conn redis.Conn, id, node, outcome string, result []byte) {
+	args := append(workflowKeys(config, id),
+		node,
+		outcome,
+		result,
+		nowToSecondsWithNanoPrecision(),
+		workflowTTL,
+		config.NamespacedKey("queue", ""),
+	)
+
+	if _, err := workflowNodeDoneScript.Do(conn, args...); err != nil {
+		Logger.Println("ERR: couldn't update workflow", id, ":", err)
+	}
+}
+
+// upstreamResults returns the results of the nodes message comes after.
+func (m *MiddlewareWorkflow) upstreamResults(id string, message *Msg) (map[string]json.RawMessage, error) {
+	upstream := make(map[string]json.RawMessage)
+
+	after, _ := message.Get("after").StringArray()
+	if len(after) == 0 {
+		return upstream, nil
+	}
+
+	conn := m.config.Pool.Get()
+	defer conn.Close()
+
+	results, err := redis.Strings(conn.Do("hmget", redis.Args{}.Add(workflowKey(m.config, id, "results")).AddFlat(after)...))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, name := range after {
+		if results[i] != "" {
+			upstream[name] = json.RawMessage(results[i])
+		}
+	}
+
+	return upstream, nil
+}
@@ -0,0 +1,164 @@
+package workers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/customerio/gospec"
+	. "github.com/customerio/gospec"
+	"github.com/garyburd/redigo/redis"
+)
+
+func WorkflowSpec(c gospec.Context) {
+	config := mkDefaultConfig()
+	w := mkWorkers(config)
+
+	conn := config.Pool.Get()
+	defer conn.Close()
+
+	wares := NewMiddleware(&MiddlewareWorkflow{config})
+
+	// pops the messages enqueued on queue, by node name.
+	popAll := func(queue string) map[string]*Msg {
+		messages := make(map[string]*Msg)
+		for {
+			json, err := redis.String(conn.Do("lpop", "prod:queue:"+queue))
+			if err != nil {
+				return messages
+			}
+			message, _ := NewMsg(json)
+			messages[message.Get("node").MustString()] = message
+		}
+	}
+
+	run := func(message *Msg, job func(context.Context) error) error {
+		return wares.callContext(context.Background(), "flow", message, job)
+	}
+
+	succeed := func(context.Context) error { return nil }
+
+	c.Specify("Add", func() {
+		flow := w.NewWorkflow("checks")
+		c.Expect(flow.Add(WorkflowNode{Name: "a", Queue: "flow", Class: "A"}), IsNil)
+
+		c.Specify("refuses duplicate nodes", func() {
+			c.Expect(flow.Add(WorkflowNode{Name: "a", Queue: "flow", Class: "A"}), Not(IsNil))
+		})
+
+		c.Specify("refuses nodes after unknown nodes", func() {
+			c.Expect(flow.Add(WorkflowNode{Name: "b", Queue: "flow", Class: "B", After: []string{"c"}}), Not(IsNil))
+		})
+	})
+
+	c.Specify("runs a chain in order", func() {
+		flow := w.NewWorkflow("chain")
+		flow.Add(WorkflowNode{Name: "fetch", Queue: "flow", Class: "Fetch", Args: []string{"url"}})
+		flow.Add(WorkflowNode{Name: "parse", Queue: "flow", Class: "Parse", After: []string{"fetch"}})
+		c.Expect(flow.Start(), IsNil)
+
+		enqueued := popAll("flow")
+		c.Expect(len(enqueued), Equals, 1)
+		c.Expect(enqueued["fetch"].Get("class").MustString(), Equals, "Fetch")
+		c.Expect(enqueued["fetch"].Args().GetIndex(0).MustString(), Equals, "url")
+
+		run(enqueued["fetch"], func(ctx context.Context) error {
+			return SetResult(ctx, map[string]int{"size": 3})
+		})
+
+		enqueued = popAll("flow")
+		c.Expect(len(enqueued), Equals, 1)
+
+		var result struct{ Size int }
+		run(enqueued["parse"], func(ctx context.Context) error {
+			return UpstreamResult(ctx, "fetch", &result)
+		})
+		c.Expect(result.Size, Equals, 3)
+
+		status, err := w.WorkflowStatus(flow.ID)
+		c.Expect(err, IsNil)
+		c.Expect(status.State, Equals, WorkflowSucceeded)
+		c.Expect(status.Total, Equals, 2)
+		c.Expect(status.Pending, Equals, 0)
+		c.Expect(string(status.Results["fetch"]), Equals, "{\"size\":3}")
+		c.Expect(status.FinishedAt.IsZero(), IsFalse)
+	})
+
+	c.Specify("runs a node once every node it comes after succeeded", func() {
+		flow := w.NewWorkflow("diamond")
+		flow.Add(WorkflowNode{Name: "a", Queue: "flow", Class: "A"})
+		flow.Add(WorkflowNode{Name: "b", Queue: "flow", Class: "B", After: []string{"a"}})
+		flow.Add(WorkflowNode{Name: "c", Queue: "flow", Class: "C", After: []string{"a"}})
+		flow.Add(WorkflowNode{Name: "d", Queue: "flow", Class: "D", After: []string{"b", "c"}})
+		flow.Start()
+
+		run(popAll("flow")["a"], succeed)
+
+		enqueued := popAll("flow")
+		c.Expect(len(enqueued), Equals, 2)
+
+		run(enqueued["b"], succeed)
+		c.Expect(len(popAll("flow")), Equals, 0)
+
+		run(enqueued["c"], succeed)
+		enqueued = popAll("flow")
+		c.Expect(len(enqueued), Equals, 1)
+		c.Expect(enqueued["d"], Not(IsNil))
+	})
+
+	c.Specify("doesn't enqueue dependants twice when a node runs twice", func() {
+		flow := w.NewWorkflow("twice")
+		flow.Add(WorkflowNode{Name: "a", Queue: "flow", Class: "A"})
+		flow.Add(WorkflowNode{Name: "b", Queue: "flow", Class: "B", After: []string{"a"}})
+		flow.Start()
+
+		a := popAll("flow")["a"]
+		run(a, succeed)
+		run(a, succeed)
+
+		length, _ := redis.Int(conn.Do("llen", "prod:queue:flow"))
+		c.Expect(length, Equals, 1)
+
+		status, _ := w.WorkflowStatus(flow.ID)
+		c.Expect(status.Pending, Equals, 1)
+	})
+
+	c.Specify("a node that fails for good", func() {
+		flow := w.NewWorkflow("failing")
+		flow.Add(WorkflowNode{Name: "a", Queue: "flow", Class: "A"})
+		flow.Add(WorkflowNode{Name: "b", Queue: "flow", Class: "B", Options: EnqueueOptions{Retry: true}})
+		flow.Add(WorkflowNode{Name: "c", Queue: "flow", Class: "C", After: []string{"a"}})
+		flow.Start()
+
+		enqueued := popAll("flow")
+
+		c.Specify("fails the workflow and stops its dependants", func() {
+			err := run(enqueued["a"], func(context.Context) error { return errors.New("boom") })
+			c.Expect(err, Not(IsNil))
+
+			status, _ := w.WorkflowStatus(flow.ID)
+			c.Expect(status.State, Equals, WorkflowFailed)
+			c.Expect(status.FailedNode, Equals, "a")
+
+			run(enqueued["b"], succeed)
+			c.Expect(len(popAll("flow")), Equals, 0)
+		})
+
+		c.Specify("leaves the workflow running while it will be retried", func() {
+			run(enqueued["b"], func(context.Context) error { return errors.New("boom") })
+
+			status, _ := w.WorkflowStatus(flow.ID)
+			c.Expect(status.State, Equals, WorkflowRunning)
+		})
+	})
+
+	c.Specify("UpstreamResult outside a workflow", func() {
+		var result int
+		c.Expect(UpstreamResult(context.Background(), "a", &result), Equals, ErrNoUpstreamResult)
+		c.Expect(SetResult(context.Background(), 1), IsNil)
+	})
+
+	c.Specify("WorkflowStatus of an unknown workflow", func() {
+		_, err := w.WorkflowStatus("missing")
+		c.Expect(err, Equals, ErrWorkflowNotFound)
+	})
+}